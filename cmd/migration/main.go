@@ -2,6 +2,7 @@ package main
 
 import (
 	"log"
+	"os"
 	"time"
 
 	"github.com/ImagineLearning/tablestorage-to-dynamo/internal/app/migration"
@@ -13,10 +14,19 @@ func main() {
 	log.Println("Beginning migration")
 	startTime := time.Now()
 
+	// Kubernetes sends SIGTERM before killing a pod, stop dispatching ranges and record the ones in flight
+	ctx, stop := migration.ShutdownContext()
+	defer stop()
+
 	config := migration.LoadMigrationConfig()
 	migration := migration.NewMigration(config)
-	migration.Start()
+	err := migration.Start(ctx)
 
 	elapsed := time.Now().Sub(startTime)
 	log.Printf("Total migration time: %v\n", elapsed)
+
+	if err != nil {
+		log.Printf("Migration failed: %v", err)
+		os.Exit(1)
+	}
 }
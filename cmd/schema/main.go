@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+
+	"github.com/ImagineLearning/tablestorage-to-dynamo/internal/app/migration"
+	dp "github.com/ImagineLearning/tablestorage-to-dynamo/internal/pkg/dataprovider"
+)
+
+// schema samples the table storage table the migration is configured for and writes a report of its columns and
+// types to stdout. The report can be passed to the migration as MAPPINGFILE.
+func main() {
+
+	log.SetFlags(log.LstdFlags | log.LUTC)
+
+	ctx, stop := migration.ShutdownContext()
+	defer stop()
+
+	config, err := migration.LoadSchemaConfig()
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+
+	log.Printf("Sampling up to %v entities from every range", config.SampleSize)
+	tableStorage := dp.NewTableStorageProvider(config.TableStorage)
+	report, err := migration.InferSchema(ctx, &tableStorage, config)
+
+	if err != nil {
+		log.Printf("Could not infer schema: %v", err)
+		os.Exit(1)
+	}
+
+	log.Printf("Found %v columns on %v entities", len(report.Columns), report.Entities)
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		log.Printf("Could not write report: %v", err)
+		os.Exit(1)
+	}
+}
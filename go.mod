@@ -1,5 +1,7 @@
 module github.com/ImagineLearning/tablestorage-to-dynamo
 
+go 1.27.1
+
 require (
 	github.com/Azure/azure-sdk-for-go v17.3.0+incompatible
 	github.com/Azure/go-autorest v10.11.1+incompatible
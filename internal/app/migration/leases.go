@@ -0,0 +1,209 @@
+package migration
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	dp "github.com/ImagineLearning/tablestorage-to-dynamo/internal/pkg/dataprovider"
+)
+
+// heldLeases tracks the ranges this process has claimed so their leases can be renewed while they are queued or
+// being migrated. Ranges claimed from the status table each take one slot per read worker until their final
+// record is written, so a process never holds more leases than it has read workers for.
+type heldLeases struct {
+	mutex   sync.Mutex
+	ranges  map[dp.QueryRange]bool
+	slotted map[dp.QueryRange]bool
+	slots   chan bool
+}
+
+func newHeldLeases(slots int) *heldLeases {
+	return &heldLeases{ranges: map[dp.QueryRange]bool{}, slotted: map[dp.QueryRange]bool{}, slots: make(chan bool, slots)}
+}
+
+// acquire waits for a free slot until ctx is cancelled and reports whether it got one
+func (held *heldLeases) acquire(ctx context.Context) bool {
+	select {
+	case held.slots <- true:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// release frees a slot that was acquired for a range that could not be claimed
+func (held *heldLeases) release() {
+	<-held.slots
+}
+
+// add starts renewing the lease on queryRange, slotted ranges keep their slot until they finish
+func (held *heldLeases) add(queryRange dp.QueryRange, slotted bool) {
+	held.mutex.Lock()
+	defer held.mutex.Unlock()
+
+	held.ranges[queryRange] = true
+	if slotted {
+		held.slotted[queryRange] = true
+	}
+}
+
+// remove stops renewing the lease on queryRange
+func (held *heldLeases) remove(queryRange dp.QueryRange) {
+	held.mutex.Lock()
+	defer held.mutex.Unlock()
+
+	delete(held.ranges, queryRange)
+}
+
+// finish forgets queryRange once its final record has been written and frees its slot
+func (held *heldLeases) finish(queryRange dp.QueryRange) {
+	held.mutex.Lock()
+	defer held.mutex.Unlock()
+
+	delete(held.ranges, queryRange)
+	if held.slotted[queryRange] {
+		delete(held.slotted, queryRange)
+		<-held.slots
+	}
+}
+
+func (held *heldLeases) list() []dp.QueryRange {
+	held.mutex.Lock()
+	defer held.mutex.Unlock()
+
+	ranges := make([]dp.QueryRange, 0, len(held.ranges))
+	for queryRange := range held.ranges {
+		ranges = append(ranges, queryRange)
+	}
+	return ranges
+}
+
+func (migration *Migration) leaseExpiry() time.Time {
+	return time.Now().Add(migration.Config.LeaseDuration)
+}
+
+// renewLeases extends every held lease three times per lease duration until stop is closed. Leases that can't be
+// renewed have finished or been taken over and are forgotten.
+func (migration *Migration) renewLeases(stop chan bool) {
+	ticker := time.NewTicker(migration.Config.LeaseDuration / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			for _, queryRange := range migration.leases.list() {
+				renewed, err := migration.Status.RenewLease(queryRange, migration.Identity, migration.leaseExpiry())
+
+				if err != nil {
+					log.Printf("Could not renew lease on range ge: %v and lt: %v: %v", queryRange.Ge, queryRange.Lt, err)
+				} else if !renewed {
+					migration.leases.remove(queryRange)
+				}
+			}
+		}
+	}
+}
+
+// claimRanges leases and dispatches every claimable range until ctx is cancelled, waiting for a free slot before
+// claiming each one. It returns how many ranges were claimed and whether other processes still hold leases that may
+// expire or finish later.
+func (migration *Migration) claimRanges(ctx context.Context, ranges []dp.QueryRange) (int, bool) {
+	records := indexRecords(migration.Status.ScanStatusTable())
+	claimed := 0
+	waiting := false
+
+	for _, queryRange := range expandSplits(ranges, records) {
+		if ctx.Err() != nil {
+			break
+		}
+
+		record, found := records[queryRange]
+		if found && !record.Claimable(time.Now(), migration.Config.MaxRangeAttempts) {
+			waiting = waiting || record.Status == dp.RangeLeased
+			continue
+		}
+
+		if !migration.leases.acquire(ctx) {
+			break
+		}
+
+		previous, ok, err := migration.Status.ClaimRange(queryRange, migration.Identity, migration.leaseExpiry(), migration.Config.MaxRangeAttempts)
+
+		if err != nil {
+			log.Printf("Could not claim range ge: %v and lt: %v: %v", queryRange.Ge, queryRange.Lt, err)
+		}
+
+		if err != nil || !ok {
+			migration.leases.release()
+			waiting = true
+			continue
+		}
+
+		migration.leases.add(queryRange, true)
+		claimed++
+		migration.dispatch(ctx, dp.ReadTask{QueryRange: queryRange, Attempt: previous.Attempt + 1, From: previous.Resume(), Rejected: previous.RejectedBefore(), LeaseOwner: migration.Identity.Owner()})
+	}
+
+	return claimed, waiting
+}
+
+// dispatchLeasedWork keeps claiming ranges until every range has completed or used up its attempts or ctx is
+// cancelled, taking over leases of processes that died along the way. Failures are reported from the status table
+// since other processes may have retried ranges this one failed.
+func (migration *Migration) dispatchLeasedWork(ctx context.Context) error {
+	if migration.Config.LeaseDuration <= 0 {
+		return fmt.Errorf("lease duration %v has to be positive to lease ranges", migration.Config.LeaseDuration)
+	}
+
+	ranges, err := migration.ranges()
+
+	if err != nil {
+		return err
+	}
+
+	stop := make(chan bool)
+	go migration.renewLeases(stop)
+	defer close(stop)
+
+	for ctx.Err() == nil {
+		claimed, waiting := migration.claimRanges(ctx, ranges)
+
+		select {
+		case <-migration.workDone():
+		case <-ctx.Done():
+			return nil
+		}
+
+		if claimed == 0 && !waiting {
+			break
+		}
+
+		if claimed == 0 {
+			log.Printf("Waiting for ranges leased by other processes")
+			select {
+			case <-time.After(migration.Config.LeaseDuration / 4):
+			case <-ctx.Done():
+			}
+		}
+	}
+
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	records := indexRecords(migration.Status.ScanStatusTable())
+	failures := new(dp.FailedRanges)
+	for _, queryRange := range expandSplits(ranges, records) {
+		if record, found := records[queryRange]; !found || !record.Completed() {
+			failures.Add(queryRange, fmt.Errorf("%v after %v attempts: %v", record.Status, record.Attempt, record.Error))
+		}
+	}
+	migration.Failures = failures
+
+	return nil
+}
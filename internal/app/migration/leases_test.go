@@ -0,0 +1,169 @@
+package migration
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	dp "github.com/ImagineLearning/tablestorage-to-dynamo/internal/pkg/dataprovider"
+	"github.com/ImagineLearning/tablestorage-to-dynamo/internal/pkg/dataprovider/dptest"
+)
+
+func newLeaseTestConfig() Config {
+	config := newTestConfig()
+	config.LeaseRanges = true
+	config.LeaseDuration = 400 * time.Millisecond
+	config.MaxRangeAttempts = 3
+	return config
+}
+
+func TestLeasedMigrationsShareKeySpace(t *testing.T) {
+	source := newTestSource()
+	sink := dptest.NewMemorySink()
+	status := dptest.NewMemoryStatus()
+
+	first := NewMigrationFromProviders(newLeaseTestConfig(), source, sink, status)
+	first.Identity = dp.Identity{JobID: "test-job", Host: "pod-1"}
+	second := NewMigrationFromProviders(newLeaseTestConfig(), source, sink, status)
+	second.Identity = dp.Identity{JobID: "test-job", Host: "pod-2"}
+
+	errs := make(chan error, 2)
+	go func() { errs <- runWithTimeout(t, first.Start) }()
+	go func() { errs <- runWithTimeout(t, second.Start) }()
+
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("Leased migration failed: %v", err)
+		}
+	}
+
+	if items := sink.Items(); len(items) != 6 {
+		t.Errorf("Expected 6 migrated items, got %v", len(items))
+	}
+
+	for _, record := range status.ScanStatusTable() {
+		if record.Status != dp.RangeCompleted || record.Attempt != 1 {
+			t.Errorf("Expected every range to be completed on the first attempt, got %+v", record)
+		}
+	}
+}
+
+func TestLeasedMigrationTakesOverExpiredLeases(t *testing.T) {
+	sink := dptest.NewMemorySink()
+	status := dptest.NewMemoryStatus(
+		dp.RangeRecord{QueryRange: dp.NewQueryRange("00", "01"), Status: dp.RangeLeased, Attempt: 1, LeaseOwner: "crashed", LeaseExpires: time.Now().Add(-time.Minute).Unix()},
+		dp.RangeRecord{QueryRange: dp.NewQueryRange("0f", "80"), Status: dp.RangeLeased, Attempt: 1, LeaseOwner: "slow", LeaseExpires: time.Now().Add(time.Second).Unix()},
+	)
+	migration := NewMigrationFromProviders(newLeaseTestConfig(), newTestSource(), sink, status)
+
+	err := runWithTimeout(t, migration.Start)
+
+	if err != nil {
+		t.Errorf("Leased migration failed: %v", err)
+	}
+
+	if items := sink.Items(); len(items) != 6 {
+		t.Errorf("Expected 6 migrated items, got %v", len(items))
+	}
+
+	for _, queryRange := range []dp.QueryRange{dp.NewQueryRange("00", "01"), dp.NewQueryRange("0f", "80")} {
+		if record, _ := status.Record(queryRange); record.Status != dp.RangeCompleted || record.Attempt != 2 {
+			t.Errorf("Expected expired lease to be taken over on the second attempt, got %+v", record)
+		}
+	}
+}
+
+func TestLeasedMigrationReclaimsFailedRanges(t *testing.T) {
+	config := newLeaseTestConfig()
+	config.ReadRetry.MaxAttempts = 1
+	source := &flakySource{MemorySource: newTestSource(), failingGe: "0f", failures: 2}
+	status := dptest.NewMemoryStatus()
+	migration := NewMigrationFromProviders(config, source, dptest.NewMemorySink(), status)
+
+	err := runWithTimeout(t, migration.Start)
+
+	if err != nil {
+		t.Errorf("Expected failed range to succeed once reclaimed: %v", err)
+	}
+
+	if record, _ := status.Record(dp.NewQueryRange("0f", "80")); record.Status != dp.RangeCompleted || record.Attempt != 3 {
+		t.Errorf("Expected range to complete on the third attempt, got %+v", record)
+	}
+}
+
+func TestLeasedMigrationReportsRangesOutOfAttempts(t *testing.T) {
+	config := newLeaseTestConfig()
+	config.ReadRetry.MaxAttempts = 1
+	source := &flakySource{MemorySource: newTestSource(), failingGe: "0f", failures: 3}
+	migration := NewMigrationFromProviders(config, source, dptest.NewMemorySink(), dptest.NewMemoryStatus())
+
+	err := runWithTimeout(t, migration.Start)
+
+	if err == nil {
+		t.Errorf("Expected migration to report the range that ran out of attempts")
+	}
+
+	if failed := migration.Failures.Ranges(); len(failed) != 1 || failed[0].QueryRange != dp.NewQueryRange("0f", "80") {
+		t.Errorf("Expected range 0f to 80 to be reported, got %v", failed)
+	}
+}
+
+func TestLeasedMigrationRequiresLeaseDuration(t *testing.T) {
+	config := newLeaseTestConfig()
+	config.LeaseDuration = 0
+	migration := NewMigrationFromProviders(config, newTestSource(), dptest.NewMemorySink(), dptest.NewMemoryStatus())
+
+	if err := runWithTimeout(t, migration.Start); err == nil {
+		t.Errorf("Expected a lease duration of 0 to be rejected")
+	}
+}
+
+// leaseCounter counts the leases its process holds on ranges without a final record
+type leaseCounter struct {
+	*dptest.MemoryStatus
+
+	mutex sync.Mutex
+	held  map[dp.QueryRange]bool
+	most  int
+}
+
+func (counter *leaseCounter) ClaimRange(queryRange dp.QueryRange, identity dp.Identity, expires time.Time, maxAttempts int) (dp.RangeRecord, bool, error) {
+	previous, ok, err := counter.MemoryStatus.ClaimRange(queryRange, identity, expires, maxAttempts)
+
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	if ok {
+		counter.held[queryRange] = true
+		if len(counter.held) > counter.most {
+			counter.most = len(counter.held)
+		}
+	}
+	return previous, ok, err
+}
+
+func (counter *leaseCounter) WriteRangeRecord(record dp.RangeRecord) {
+	counter.MemoryStatus.WriteRangeRecord(record)
+
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	delete(counter.held, record.QueryRange)
+}
+
+func TestLeasedMigrationOnlyClaimsRangesForFreeReaders(t *testing.T) {
+	config := newLeaseTestConfig()
+	config.NumWorkers = 1
+	status := &leaseCounter{MemoryStatus: dptest.NewMemoryStatus(), held: map[dp.QueryRange]bool{}}
+	migration := NewMigrationFromProviders(config, newTestSource(), dptest.NewMemorySink(), status)
+
+	if err := runWithTimeout(t, migration.Start); err != nil {
+		t.Errorf("Leased migration failed: %v", err)
+	}
+
+	if status.most != 1 {
+		t.Errorf("Expected a single read worker to hold 1 lease at a time, held up to %v", status.most)
+	}
+
+	if held := migration.leases.list(); len(held) != 0 {
+		t.Errorf("Expected no leases to be renewed once their ranges finished, still renewing %v", held)
+	}
+}
@@ -1,18 +1,17 @@
 package migration
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"os"
 	"sync"
+	"time"
 
 	dp "github.com/ImagineLearning/tablestorage-to-dynamo/internal/pkg/dataprovider"
 	"github.com/kelseyhightower/envconfig"
 )
 
-var (
-	hexCodes = []string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9", "a", "b", "c", "d", "e", "f"}
-)
-
 // Config represents all config values needed for a migration.
 type Config struct {
 	Dynamo         dp.DynamoConfig
@@ -21,18 +20,65 @@ type Config struct {
 	BufferSize     int      `default:"500"`
 	Ranges         []string `required:"true"`
 	RangePrecision int      `default:"3"`
+	KeyAlphabet    string   `default:"hex-lower"` // name of a dp.KeyAlphabets entry or the literal characters of partition keys
+	ReadRetry      dp.RetryPolicy
+	JobID          string // recorded on every range this process migrates, defaults to the host name
+
+	TargetRangeItems int // plan ranges of about this many items from samples instead of expanding RANGES, 0 disables planning
+	SampleSize       int `default:"1000"` // how many keys are sampled from every range of RANGES when planning
+
+	LeaseRanges      bool          // claim ranges through leases in the status table so identical processes can share the key space
+	LeaseDuration    time.Duration `default:"5m"`
+	MaxRangeAttempts int           `default:"3"` // how often partial and failed ranges are reclaimed in lease mode
+
+	ShutdownGracePeriod time.Duration `default:"20s"` // how long ranges in flight may take to finish once shutdown starts
+
+	Split dp.SplitPolicy // when ranges too big for one read worker are split
+
+	Key         dp.KeySchema       // key attributes of the target table and how they are built from entity keys
+	Columns     dp.ColumnSelection // properties migrated besides TABLESTORAGE_COLUMNNAMES
+	ColumnTypes map[string]string  // attribute types columns are converted to, i.e. Id:S,Payload:B,Meta:M, instead of the one their Edm type maps to
+	StrictTypes bool               // fail entities with values that can't be converted instead of skipping the value
+	InvalidJSON string             // what happens to values of JSON, M, L, SS and NS columns that aren't valid JSON: keep, null, skip or fail
+	MappingFile string             // JSON file with columnNames and columnTypes, as written by the schema command
+
+	EmptyStrings       string            // what empty strings are migrated to: omit, null, empty or sentinel=<value>, omitted by default
+	Nulls              string            // what nulls are migrated to, same policies as EMPTYSTRINGS
+	ColumnEmptyStrings map[string]string // EMPTYSTRINGS per column, i.e. Notes:empty,Code:sentinel=-
+	ColumnNulls        map[string]string // NULLS per column
+
+	Transforms string // JSON list of transforms applied to every item before it is written, see the README
+
+	LargeItems dp.LargeItemPolicy // what happens to items too big for dynamo
+
+	TimeFormat        string            // how times are written: epoch, epochmillis, rfc3339, rfc3339nano or a layout, 2006-01-02T15:04:05.999999Z by default
+	ColumnTimeFormats map[string]string // TIMEFORMAT per column, the entity's Timestamp is the column Timestamp, i.e. Timestamp:epoch,Due:rfc3339nano
+	TimestampName     string            // attribute the entity's Timestamp is written to, Timestamp if empty
+	DropTimestamp     bool              // don't write the entity's Timestamp at all
+
+	TTL dp.TTLPolicy // derives the expiry dynamo TTL deletes items at
 }
 
 // LoadMigrationConfig loads all migration configuration values from env vars.
 func LoadMigrationConfig() Config {
+	config, err := loadConfig()
+
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+
+	return config
+}
+
+func loadConfig() (Config, error) {
 	var config Config
 
 	var dynamoConfig dp.DynamoConfig
 	err := envconfig.Process("DYNAMO", &dynamoConfig)
 
 	if err != nil {
-		log.Println(err.Error())
-		os.Exit(1)
+		return config, err
 	}
 	config.Dynamo = dynamoConfig
 
@@ -40,176 +86,486 @@ func LoadMigrationConfig() Config {
 	err = envconfig.Process("TABLESTORAGE", &tsConfig)
 
 	if err != nil {
-		log.Println(err.Error())
-		os.Exit(1)
+		return config, err
 	}
 	config.TableStorage = tsConfig
 
 	err = envconfig.Process("", &config)
 
 	if err != nil {
-		log.Println(err.Error())
-		os.Exit(1)
+		return config, err
 	}
 
-	return config
+	err = loadMappingFile(&config)
+
+	return config, err
 }
 
 // Migration contains all objects needed for migration including work queues and worker pools
 type Migration struct {
-	TableStorage    dp.TableStorageProvider
-	Dynamo          dp.DynamoProvider
-	Status          dp.DynamoProvider
+	Source          dp.Source
+	Sink            dp.Sink
+	Status          dp.StatusStore
 	ReadWorkQueue   dp.TableStorageReadWork
 	ReadWorkerPool  chan dp.TableStorageReadWork
 	WriteWorkQueue  dp.DynamoWriteWork
 	WriteWorkerPool chan dp.DynamoWriteWork
 	Config          Config
 	WaitGrp         *sync.WaitGroup
+	Failures        *dp.FailedRanges
+	Unmapped        *dp.ColumnReport
+	Skipped         *dp.ColumnReport
+	LargeItems      *dp.LargeItems
+	TTL             *dp.TTL
+	Blobs           dp.BlobStore // large items are offloaded to, built from LARGEITEMS_BLOB* if nil
+	Identity        dp.Identity
+
+	inFlight *inFlightRanges
+	leases   *heldLeases
+	rejects  *dp.RejectsFile
 }
 
 // NewMigration returns a migration which has the table storage table, work queue, wait group, etc
 func NewMigration(migrationConfig Config) Migration {
+	tableStorage := dp.NewTableStorageProvider(migrationConfig.TableStorage)
+	dynamo := dp.NewDynamoProvider(migrationConfig.Dynamo)
 	statusProvider := dp.NewMigrationStatusProvider(migrationConfig.Dynamo)
-	statusProvider.NewMigrationStatusTable()
+
+	return NewMigrationFromProviders(migrationConfig, &tableStorage, &dynamo, &statusProvider)
+}
+
+// NewMigrationFromProviders returns a migration from source to sink that keeps track of its progress in status
+func NewMigrationFromProviders(migrationConfig Config, source dp.Source, sink dp.Sink, status dp.StatusStore) Migration {
+	status.NewMigrationStatusTable()
+
+	host, err := os.Hostname()
+	if err != nil {
+		log.Printf("Could not determine host name: %v", err)
+	}
+
+	jobID := migrationConfig.JobID
+	if jobID == "" {
+		jobID = host
+	}
+
+	leases := newHeldLeases(migrationConfig.NumWorkers)
 
 	return Migration{
-		TableStorage:    dp.NewTableStorageProvider(migrationConfig.TableStorage),
-		Dynamo:          dp.NewDynamoProvider(migrationConfig.Dynamo),
-		Status:          statusProvider,
+		Source:          source,
+		Sink:            sink,
+		Status:          status,
 		ReadWorkQueue:   make(dp.TableStorageReadWork, migrationConfig.BufferSize),
 		ReadWorkerPool:  make(chan dp.TableStorageReadWork, migrationConfig.NumWorkers),
 		WriteWorkQueue:  make(dp.DynamoWriteWork, migrationConfig.BufferSize),
 		WriteWorkerPool: make(chan dp.DynamoWriteWork, migrationConfig.NumWorkers),
 		Config:          migrationConfig,
 		WaitGrp:         new(sync.WaitGroup),
+		Failures:        new(dp.FailedRanges),
+		Unmapped:        dp.NewColumnReport(),
+		Skipped:         dp.NewColumnReport(),
+		Identity:        dp.Identity{JobID: jobID, Host: host},
+		inFlight:        newInFlightRanges(status, leases.finish),
+		leases:          leases,
 	}
 }
 
-func queryRangeHasBeenMigrated(alreadyMigrated []dp.QueryRange, queryRange dp.QueryRange) bool {
-	for _, value := range alreadyMigrated {
-		if value.Ge == queryRange.Ge && value.Lt == queryRange.Lt {
-			return true
-		}
+func indexRecords(records []dp.RangeRecord) map[dp.QueryRange]dp.RangeRecord {
+	index := make(map[dp.QueryRange]dp.RangeRecord, len(records))
+	for _, record := range records {
+		index[record.QueryRange] = record
+	}
+	return index
+}
+
+// rangeSpec describes the key space to migrate. Partition keys are lowercase hex unless KeyAlphabet says otherwise.
+func (migration *Migration) rangeSpec() (dp.RangeSpec, error) {
+	return newRangeSpec(migration.Config.Ranges, migration.Config.RangePrecision, migration.Config.KeyAlphabet)
+}
+
+func newRangeSpec(prefixes []string, precision int, keyAlphabet string) (dp.RangeSpec, error) {
+	spec := dp.RangeSpec{
+		Prefixes:  prefixes,
+		Precision: precision,
 	}
-	return false
+
+	if keyAlphabet == "" {
+		return spec, nil
+	}
+
+	alphabet, err := dp.ParseAlphabet(keyAlphabet)
+	spec.Alphabet = alphabet
+	return spec, err
+}
+
+// ranges enumerates the query ranges to migrate
+func (migration *Migration) ranges() ([]dp.QueryRange, error) {
+	spec, err := migration.rangeSpec()
+	if err != nil {
+		return nil, err
+	}
+
+	if migration.Config.TargetRangeItems > 0 {
+		return migration.plannedRanges(spec)
+	}
+
+	ranges, err := migration.Source.Ranges(spec)
+	if err != nil {
+		return nil, fmt.Errorf("could not enumerate ranges to migrate: %v", err)
+	}
+	return ranges, nil
 }
 
-func (migration *Migration) generateRanges(ranges chan string, currentPrecision int) {
-	if currentPrecision == migration.Config.RangePrecision {
-		ranges <- migration.Config.Ranges[len(migration.Config.Ranges)-1]
-		return
+// undoRanges enumerates the query ranges to delete without writing to the status table, so undoing a migration
+// never changes its status. A plan the migration recorded is reused, the key space is enumerated otherwise.
+func (migration *Migration) undoRanges() ([]dp.QueryRange, error) {
+	spec, err := migration.rangeSpec()
+	if err != nil {
+		return nil, err
 	}
 
-	if len(ranges) == 0 {
-		for _, hexCode := range migration.Config.Ranges[0 : len(migration.Config.Ranges)-1] {
-			ranges <- hexCode
+	if migration.Config.TargetRangeItems > 0 {
+		grid, err := dp.GenerateRanges(spec)
+		if err != nil || len(grid) == 0 {
+			return grid, err
 		}
-	} else {
-		for i := len(ranges); i > 0; i-- {
-			elem := <-ranges
-			for _, code := range hexCodes {
-				ranges <- elem + code
-			}
+
+		span := dp.NewQueryRange(grid[0].Ge, grid[len(grid)-1].Lt)
+		if ranges, ok := reusablePlan(splitRoots(migration.Status.ScanStatusTable()), span); ok {
+			return ranges, nil
+		}
+	}
+
+	ranges, err := migration.Source.Ranges(spec)
+	if err != nil {
+		return nil, fmt.Errorf("could not enumerate ranges to delete: %v", err)
+	}
+	return ranges, nil
+}
+
+// dispatchReadWork queues every range that has not been completed yet until ctx is cancelled
+func (migration *Migration) dispatchReadWork(ctx context.Context, ranges []dp.QueryRange, alreadyMigrated []dp.RangeRecord) error {
+	previous := indexRecords(alreadyMigrated)
+	for _, queryRange := range expandSplits(ranges, previous) {
+		record, found := previous[queryRange]
+		if found && record.Completed() {
+			continue
+		}
+
+		if !migration.dispatch(ctx, dp.ReadTask{QueryRange: queryRange, Attempt: record.Attempt + 1, From: record.Resume(), Rejected: record.RejectedBefore()}) {
+			break
 		}
 	}
+	return nil
+}
+
+// keyMapping returns the mapping of entities to the keys of their items, all that is needed to delete them
+func (migration *Migration) keyMapping() (*dp.Mapping, error) {
+	keys := migration.Config.Key
+	if err := keys.Validate(); err != nil {
+		return nil, err
+	}
 
-	currentPrecision++
-	migration.generateRanges(ranges, currentPrecision)
+	if verifier, ok := migration.Sink.(dp.KeyVerifier); ok {
+		if err := verifier.VerifyKeys(keys.KeyNames()); err != nil {
+			return nil, err
+		}
+	}
+
+	return &dp.Mapping{Keys: keys}, nil
 }
 
-func (migration *Migration) dispatchReadWork(alreadyMigrated []dp.QueryRange) {
-	ranges := make(chan string, 150000)
-	migration.generateRanges(ranges, 0)
+// mapping returns how entities are converted to items. The key schema is checked against the sink if it knows its
+// keys, a mismatch would fail every write.
+func (migration *Migration) mapping() (*dp.Mapping, error) {
+	keys := migration.Config.Key
+	if err := keys.Validate(); err != nil {
+		return nil, err
+	}
+
+	columns := migration.Config.Columns
+	if err := columns.Validate(); err != nil {
+		return nil, err
+	}
+
+	if len(migration.Config.TableStorage.ColumnNames) == 0 && !columns.All && len(columns.Include) == 0 {
+		return nil, fmt.Errorf("no columns to migrate, set TABLESTORAGE_COLUMNNAMES, COLUMNS_INCLUDE or COLUMNS_ALL")
+	}
+
+	types, err := dp.ParseColumnTypes(migration.Config.ColumnTypes)
+	if err != nil {
+		return nil, err
+	}
+
+	invalidJSON, err := dp.ParseJSONFallback(migration.Config.InvalidJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	empty, err := dp.ParseEmptyValues(migration.Config.EmptyStrings, migration.Config.Nulls, migration.Config.ColumnEmptyStrings, migration.Config.ColumnNulls)
+	if err != nil {
+		return nil, err
+	}
+
+	transforms, err := dp.ParsePipeline(migration.Config.Transforms)
+	if err != nil {
+		return nil, err
+	}
+	if err := transforms.Validate(keys.KeyNames()); err != nil {
+		return nil, err
+	}
 
-	close(ranges)
-	ge := <-ranges
-	queryRange := dp.QueryRange{Ge: ge}
+	timeFormats, err := dp.ParseTimeFormats(migration.Config.TimeFormat, migration.Config.ColumnTimeFormats)
+	if err != nil {
+		return nil, err
+	}
 
-	for lt := range ranges {
-		queryRange.Lt = lt
+	if err := migration.Config.TTL.Validate(keys.KeyNames()); err != nil {
+		return nil, err
+	}
+	migration.TTL = dp.NewTTL(migration.Config.TTL)
 
-		if !queryRangeHasBeenMigrated(alreadyMigrated, queryRange) {
-			migration.WaitGrp.Add(1)
-			migration.ReadWorkQueue <- queryRange
+	if err := migration.Config.LargeItems.Validate(); err != nil {
+		return nil, err
+	}
+
+	if verifier, ok := migration.Sink.(dp.KeyVerifier); ok {
+		if err := verifier.VerifyKeys(keys.KeyNames()); err != nil {
+			return nil, err
 		}
+	}
 
-		queryRange.Ge = lt
+	return &dp.Mapping{
+		Keys:        keys,
+		ColumnNames: migration.Config.TableStorage.ColumnNames,
+		Columns:     columns,
+		Types:       types,
+		Strict:      migration.Config.StrictTypes,
+		Empty:       empty,
+		Transforms:  transforms,
+		InvalidJSON: invalidJSON,
+		LargeItems:  migration.largeItems(keys),
+		TimeFormats: timeFormats,
+		Timestamp:   migration.Config.TimestampName,
+		NoTimestamp: migration.Config.DropTimestamp,
+		TTL:         migration.TTL,
+		Unmapped:    migration.Unmapped,
+		Skipped:     migration.Skipped,
+	}, nil
+}
+
+// largeItems returns the handler of items too big for dynamo, items are rejected to a file that is closed once the
+// migration finishes
+func (migration *Migration) largeItems(keys dp.KeySchema) *dp.LargeItems {
+	policy := migration.Config.LargeItems
+	if migration.Blobs == nil && (policy.BlobDir != "" || policy.BlobBucket != "") {
+		migration.Blobs = dp.NewBlobStore(policy)
 	}
+
+	migration.rejects = dp.NewRejectsFile(policy.RejectsFile)
+	migration.LargeItems = dp.NewLargeItems(policy, keys.KeyNames(), migration.Blobs, migration.rejects)
+	return migration.LargeItems
 }
 
-// Start stars migrating data from table storage to dynamo using a dispatch, worker pool, work queue pattern
-func (migration *Migration) Start() {
+// startWorkers starts NumWorkers read and write workers, ranges are recorded in status unless it is nil, split decides
+// when read workers split ranges and startWrite what write workers do. The returned function stops them.
+func (migration *Migration) startWorkers(ctx context.Context, status dp.StatusStore, split dp.SplitPolicy, startWrite func(worker *dp.DynamoWriteWorker)) func() {
+	readWorkers := make([]dp.TableStorageReadWorker, migration.Config.NumWorkers)
+	writeWorkers := make([]dp.DynamoWriteWorker, migration.Config.NumWorkers)
 
-	// Create and start workers
 	for i := 0; i < migration.Config.NumWorkers; i++ {
-		readWorker := dp.NewTableStorageReadWorker(i+1, migration.ReadWorkerPool)
-		readWorker.Start(&migration.TableStorage, &migration.Status, migration.WriteWorkQueue, migration.WaitGrp)
+		readWorkers[i] = dp.NewTableStorageReadWorker(i+1, migration.ReadWorkerPool)
+		readWorkers[i].Start(migration.Source, status, migration.WriteWorkQueue, migration.Config.ReadRetry, split, migration.dispatchChildren(ctx), migration.Failures, migration.Identity, migration.WaitGrp)
 
-		writeWorker := dp.NewDynamoWriteWorker(i+1, migration.WriteWorkerPool)
-		writeWorker.Start(&migration.Dynamo, &migration.Status, &migration.Config.TableStorage.ColumnNames, migration.WaitGrp)
+		writeWorkers[i] = dp.NewDynamoWriteWorker(i+1, migration.WriteWorkerPool)
+		startWrite(&writeWorkers[i])
 	}
 
-	// Dispatch work
+	return func() {
+		for i := range readWorkers {
+			readWorkers[i].Stop()
+			writeWorkers[i].Stop()
+		}
+	}
+}
+
+// startDispatcher hands work to workers only as they become free, so dispatching blocks once every read worker is
+// busy and the read work queue is full, and read workers block once every write worker is busy and the write work
+// queue is full. Read work stops being handed out once ctx is cancelled, write work keeps going to the next free
+// write worker until the returned function is called.
+func (migration *Migration) startDispatcher(ctx context.Context) func() {
+	stop := make(chan bool)
+
 	go func() {
 		for {
 			select {
-			case readWork := <-migration.ReadWorkQueue:
-				go func() {
-					worker := <-migration.ReadWorkerPool
+			case worker := <-migration.ReadWorkerPool:
+				select {
+				case readWork := <-migration.ReadWorkQueue:
 					worker <- readWork
-				}()
-			case writeWork := <-migration.WriteWorkQueue:
-				go func() {
-					worker := <-migration.WriteWorkerPool
+				case <-ctx.Done():
+					return
+				case <-stop:
+					return
+				}
+			case <-ctx.Done():
+				return
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	go func() {
+		for {
+			select {
+			case worker := <-migration.WriteWorkerPool:
+				select {
+				case writeWork := <-migration.WriteWorkQueue:
 					worker <- writeWork
-				}()
+				case <-stop:
+					return
+				}
+			case <-stop:
+				return
 			}
 		}
 	}()
 
-	alreadyMigrated := migration.Status.ScanStatusTable()
+	return func() {
+		close(stop)
+	}
+}
+
+// finish waits for all dispatched work, flushes the sink and reports the ranges that could not be migrated
+func (migration *Migration) finish(ctx context.Context) error {
+	interrupted := migration.wait(ctx)
+
+	err := migration.Sink.Flush()
+	if err != nil {
+		log.Printf("Could not flush sink: %v", err)
+	}
+
+	failed := migration.Failures.Ranges()
+	for _, failedRange := range failed {
+		log.Printf("Failed range %v", failedRange)
+	}
+
+	unmapped, counts := migration.Unmapped.Columns()
+	for _, column := range unmapped {
+		log.Printf("Column %v was found on %v entities but not migrated, add it to TABLESTORAGE_COLUMNNAMES or COLUMNS_EXCLUDE", column, counts[column])
+	}
+
+	skipped, counts := migration.Skipped.Columns()
+	for _, column := range skipped {
+		log.Printf("Column %v was skipped on %v entities because its value could not be converted", column, counts[column])
+	}
+
+	if expired := migration.TTL.Expired(); expired > 0 {
+		log.Printf("%v entities were skipped because they already expired", expired)
+	}
+
+	for strategy, count := range migration.LargeItems.Handled() {
+		log.Printf("%v items too big for dynamo were handled by %v", count, strategy)
+	}
+
+	if err := migration.rejects.Close(); err != nil {
+		log.Printf("Could not close rejects file: %v", err)
+	}
+
+	if interrupted {
+		return ErrInterrupted
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%v ranges could not be migrated", len(failed))
+	}
+	return err
+}
+
+// Start stars migrating data from table storage to dynamo using a dispatch, worker pool, work queue pattern.
+// Cancelling ctx stops dispatching ranges and records ranges that do not finish within the shutdown grace period
+// as incomplete.
+func (migration *Migration) Start(ctx context.Context) error {
+
+	split, err := migration.splitPolicy()
+	if err != nil {
+		return err
+	}
+
+	mapping, err := migration.mapping()
+	if err != nil {
+		return err
+	}
+
+	// Create and start workers
+	stopWorkers := migration.startWorkers(ctx, migration.inFlight, split, func(worker *dp.DynamoWriteWorker) {
+		worker.Start(migration.Sink, mapping)
+	})
+	defer stopWorkers()
+
+	// Dispatch work
+	stopDispatcher := migration.startDispatcher(ctx)
+	defer stopDispatcher()
 
 	// Create and dispatch read work
-	migration.dispatchReadWork(alreadyMigrated)
+	if migration.Config.LeaseRanges {
+		err = migration.dispatchLeasedWork(ctx)
+	} else {
+		var ranges []dp.QueryRange
+		ranges, err = migration.ranges()
+		if err == nil {
+			err = migration.dispatchReadWork(ctx, ranges, migration.Status.ScanStatusTable())
+		}
+	}
+
+	if err != nil {
+		return err
+	}
 
 	// Wait for work to be completed
-	migration.WaitGrp.Wait()
+	err = migration.finish(ctx)
+
+	if err == ErrInterrupted {
+		incomplete := migration.inFlight.recordIncomplete(migration.Identity)
+		log.Printf("Recorded %v ranges in flight as incomplete", incomplete)
+	}
+	return err
 }
 
-//Undo deletes data from table storage in dynamo, or in other words, undoes the migration.
-func (migration *Migration) Undo() {
+// Undo deletes data from table storage in dynamo, or in other words, undoes the migration. Only keys are mapped and
+// the status table is left as it is. Migrations that chunk large items can't be undone, undo would only delete the
+// manifests and leave the chunks behind.
+func (migration *Migration) Undo(ctx context.Context) error {
+	if dp.LargeItemStrategy(migration.Config.LargeItems.Strategy) == dp.LargeChunk {
+		return fmt.Errorf("undo can't delete the chunks of items migrated with large item strategy %v", dp.LargeChunk)
+	}
 
-	// Create and start workers
-	for i := 0; i < migration.Config.NumWorkers; i++ {
-		readWorker := dp.NewTableStorageReadWorker(i+1, migration.ReadWorkerPool)
-		readWorker.Start(&migration.TableStorage, &migration.Status, migration.WriteWorkQueue, migration.WaitGrp)
+	mapping, err := migration.keyMapping()
+	if err != nil {
+		return err
+	}
 
-		writeWorker := dp.NewDynamoWriteWorker(i+1, migration.WriteWorkerPool)
-		writeWorker.StartDelete(&migration.Dynamo, migration.WaitGrp)
+	ranges, err := migration.undoRanges()
+	if err != nil {
+		return err
 	}
 
+	// Create and start workers
+	stopWorkers := migration.startWorkers(ctx, nil, dp.SplitPolicy{}, func(worker *dp.DynamoWriteWorker) {
+		worker.StartDelete(migration.Sink, mapping)
+	})
+	defer stopWorkers()
+
 	// Dispatch work
-	go func() {
-		for {
-			select {
-			case readWork := <-migration.ReadWorkQueue:
-				go func() {
-					worker := <-migration.ReadWorkerPool
-					worker <- readWork
-				}()
-			case writeWork := <-migration.WriteWorkQueue:
-				go func() {
-					worker := <-migration.WriteWorkerPool
-					worker <- writeWork
-				}()
-			}
-		}
-	}()
+	stopDispatcher := migration.startDispatcher(ctx)
+	defer stopDispatcher()
 
 	// Create and dispatch read work
-	migration.dispatchReadWork([]dp.QueryRange{})
+	err = migration.dispatchReadWork(ctx, ranges, []dp.RangeRecord{})
+	if err != nil {
+		return err
+	}
 
 	// Wait for work to be completed
-	migration.WaitGrp.Wait()
+	return migration.finish(ctx)
 }
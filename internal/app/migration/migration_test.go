@@ -1,14 +1,104 @@
 package migration
 
 import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	dp "github.com/ImagineLearning/tablestorage-to-dynamo/internal/pkg/dataprovider"
+	"github.com/ImagineLearning/tablestorage-to-dynamo/internal/pkg/dataprovider/dptest"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
 )
 
+func newTestConfig() Config {
+	return Config{
+		TableStorage:   dp.TableStorageConfig{ColumnNames: []string{"Name", "Count"}},
+		NumWorkers:     4,
+		BufferSize:     10,
+		Ranges:         []string{"0", "8", "g"},
+		RangePrecision: 2,
+		ReadRetry:      dp.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+		JobID:          "test-job",
+	}
+}
+
+func newTestEntity(partitionKey string, rowKey string) *storage.Entity {
+	return &storage.Entity{
+		PartitionKey: partitionKey,
+		RowKey:       rowKey,
+		TimeStamp:    time.Date(2018, 12, 1, 0, 0, 0, 0, time.UTC),
+		Properties: map[string]interface{}{
+			"Name":  "entity " + partitionKey,
+			"Count": int64(len(rowKey)),
+		},
+	}
+}
+
+func newTestSource() *dptest.MemorySource {
+	return dptest.NewMemorySource(
+		newTestEntity("00a", "1"),
+		newTestEntity("00a", "2"),
+		newTestEntity("3f5", "1"),
+		newTestEntity("8", "1"),
+		newTestEntity("a01", "1"),
+		newTestEntity("fff", "1"),
+	)
+}
+
+// flakySource fails reads of ranges starting with failingGe until it has failed failures times
+type flakySource struct {
+	*dptest.MemorySource
+	failingGe string
+	failures  int
+
+	mutex sync.Mutex
+	reads int
+}
+
+func (source *flakySource) ReadPage(queryRange dp.QueryRange, from dp.Continuation) ([]*storage.Entity, dp.Continuation, error) {
+	source.mutex.Lock()
+	defer source.mutex.Unlock()
+
+	if queryRange.Ge == source.failingGe {
+		source.reads++
+		if source.reads <= source.failures {
+			return nil, dp.Continuation{}, errors.New("server busy")
+		}
+	}
+	return source.MemorySource.ReadPage(queryRange, from)
+}
+
+func runWithTimeout(t *testing.T, run func(ctx context.Context) error) error {
+	done := make(chan error)
+	go func() {
+		done <- run(context.Background())
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(10 * time.Second):
+		t.Fatalf("migration did not finish within 10 seconds")
+	}
+	return nil
+}
+
 func TestMigrate(t *testing.T) {
+	requireCloud(t)
 	migration := NewMigration(config)
-	migration.Start()
+	migration.Start(context.Background())
 
-	results := migration.Dynamo.ScanTable()
+	dynamo := dp.NewDynamoProvider(config.Dynamo)
+	results := dynamo.ScanTable()
 
 	if len(results) == 0 {
 		t.Errorf("TestMigrate failed. No data has been migrated.")
@@ -16,12 +106,583 @@ func TestMigrate(t *testing.T) {
 }
 
 func TestUndo(t *testing.T) {
+	requireCloud(t)
 	migration := NewMigration(config)
-	migration.Undo()
+	migration.Undo(context.Background())
 
-	results := migration.Dynamo.ScanTable()
+	dynamo := dp.NewDynamoProvider(config.Dynamo)
+	results := dynamo.ScanTable()
 
 	if len(results) != 0 {
 		t.Errorf("TestUndo failed. Data still exists in table.")
 	}
 }
+
+func TestStartMigratesEveryRange(t *testing.T) {
+	sink := dptest.NewMemorySink()
+	status := dptest.NewMemoryStatus()
+	migration := NewMigrationFromProviders(newTestConfig(), newTestSource(), sink, status)
+
+	err := runWithTimeout(t, migration.Start)
+
+	if err != nil {
+		t.Errorf("Migration failed: %v", err)
+	}
+
+	items := sink.Items()
+	if len(items) != 6 {
+		t.Errorf("Expected 6 migrated items, got %v", len(items))
+	}
+
+	for _, item := range items {
+		if item["Name"] == nil || item["Count"] == nil || item["Timestamp"] == nil {
+			t.Errorf("Migrated item is missing columns: %v", item)
+		}
+	}
+
+	ranges, _ := migration.ranges()
+	if migrated := status.ScanStatusTable(); len(migrated) != len(ranges) {
+		t.Errorf("Expected %v ranges in status table, got %v", len(ranges), len(migrated))
+	}
+
+	record, _ := status.Record(dp.NewQueryRange("00", "01"))
+	if record.Status != dp.RangeCompleted || record.ItemsRead != 2 || record.ItemsWritten != 2 || record.Bytes == 0 {
+		t.Errorf("Expected a completed record with 2 items read and written, got %+v", record)
+	}
+
+	if record.Attempt != 1 || record.JobID != "test-job" || record.Host == "" {
+		t.Errorf("Expected record to name the first attempt, job and host, got %+v", record)
+	}
+
+	if record.StartedAt.IsZero() || record.FinishedAt.Before(record.StartedAt) {
+		t.Errorf("Expected record to have start and end times, got %v and %v", record.StartedAt, record.FinishedAt)
+	}
+
+	if sink.Flushes != 1 {
+		t.Errorf("Expected sink to be flushed once, got %v", sink.Flushes)
+	}
+}
+
+func TestStartResumesFromStatusTable(t *testing.T) {
+	sink := dptest.NewMemorySink()
+	status := dptest.NewMemoryStatus(
+		dp.RangeRecord{QueryRange: dp.NewQueryRange("00", "01")},
+		dp.NewRangeRecord(dp.NewQueryRange("0f", "80"), dp.RangeCompleted),
+		dp.RangeRecord{QueryRange: dp.NewQueryRange("8f", "g"), Status: dp.RangePartial, Attempt: 1},
+	)
+	migration := NewMigrationFromProviders(newTestConfig(), newTestSource(), sink, status)
+
+	runWithTimeout(t, migration.Start)
+
+	migrated := map[string]bool{}
+	for _, item := range sink.Items() {
+		migrated[*item["PartitionKey"].S] = true
+	}
+
+	if migrated["00a"] || migrated["3f5"] || migrated["8"] {
+		t.Errorf("Completed ranges should have been skipped, got %v", migrated)
+	}
+
+	if !migrated["a01"] || !migrated["fff"] {
+		t.Errorf("Partially migrated range should have been migrated again, got %v", migrated)
+	}
+
+	if record, _ := status.Record(dp.NewQueryRange("8f", "g")); record.Status != dp.RangeCompleted || record.Attempt != 2 {
+		t.Errorf("Expected second attempt at range 8f to g to complete, got %+v", record)
+	}
+}
+
+func TestUndoDeletesMigratedItems(t *testing.T) {
+	source := newTestSource()
+	sink := dptest.NewMemorySink()
+
+	migration := NewMigrationFromProviders(newTestConfig(), source, sink, dptest.NewMemoryStatus())
+	runWithTimeout(t, migration.Start)
+
+	undo := NewMigrationFromProviders(newTestConfig(), source, sink, dptest.NewMemoryStatus())
+	runWithTimeout(t, undo.Undo)
+
+	if items := sink.Items(); len(items) != 0 {
+		t.Errorf("Expected undo to delete every item, %v remain", len(items))
+	}
+}
+
+func TestUndoOnlyNeedsKeysAndLeavesStatusAlone(t *testing.T) {
+	config := newTestConfig()
+	config.TargetRangeItems = 2
+	config.SampleSize = 10
+	source := newTestSource()
+	sink := dptest.NewMemorySink()
+	status := dptest.NewMemoryStatus()
+
+	migration := NewMigrationFromProviders(config, source, sink, status)
+	if err := runWithTimeout(t, migration.Start); err != nil {
+		t.Errorf("Migration failed: %v", err)
+	}
+	migrated := indexRecords(status.ScanStatusTable())
+
+	undoConfig := newTestConfig()
+	undoConfig.TargetRangeItems = 2
+	undoConfig.SampleSize = 10
+	undoConfig.TableStorage.ColumnNames = nil
+	undo := NewMigrationFromProviders(undoConfig, source, sink, status)
+	if err := runWithTimeout(t, undo.Undo); err != nil {
+		t.Errorf("Expected undo to need no columns: %v", err)
+	}
+
+	if items := sink.Items(); len(items) != 0 {
+		t.Errorf("Expected undo to delete every item, %v remain", len(items))
+	}
+
+	if records := indexRecords(status.ScanStatusTable()); !reflect.DeepEqual(records, migrated) {
+		t.Errorf("Expected undo to leave the status table as it was, got %v", records)
+	}
+}
+
+func TestUndoRefusesChunkedMigrations(t *testing.T) {
+	config := newTestConfig()
+	config.LargeItems.Strategy = "chunk"
+	sink := dptest.NewMemorySink()
+	sink.WriteBatch([]map[string]*dynamodb.AttributeValue{{"PartitionKey": {S: aws.String("00a")}, "RowKey": {S: aws.String("1")}}})
+	undo := NewMigrationFromProviders(config, newTestSource(), sink, dptest.NewMemoryStatus())
+
+	if err := runWithTimeout(t, undo.Undo); err == nil {
+		t.Errorf("Expected undo to refuse a migration that chunks large items")
+	}
+
+	if items := sink.Items(); len(items) != 1 {
+		t.Errorf("Expected undo to delete nothing, %v items remain", len(items))
+	}
+}
+
+func TestStartAndUndoMapKeys(t *testing.T) {
+	config := newTestConfig()
+	config.Key = dp.KeySchema{HashKey: "pk", HashTemplate: "{PartitionKey}#{RowKey}", Prefix: "entity#", HashOnly: true}
+	source := newTestSource()
+	sink := dptest.NewMemorySink("pk")
+
+	migration := NewMigrationFromProviders(config, source, sink, dptest.NewMemoryStatus())
+	if err := runWithTimeout(t, migration.Start); err != nil {
+		t.Errorf("Migration failed: %v", err)
+	}
+
+	items := sink.Items()
+	if len(items) != 6 {
+		t.Errorf("Expected 6 migrated items, got %v", len(items))
+	}
+
+	for _, item := range items {
+		if item["pk"] == nil || !strings.HasPrefix(*item["pk"].S, "entity#") || item["PartitionKey"] != nil {
+			t.Errorf("Expected item to be keyed on a prefixed composite pk only, got %v", item)
+		}
+	}
+
+	undo := NewMigrationFromProviders(config, source, sink, dptest.NewMemoryStatus())
+	if err := runWithTimeout(t, undo.Undo); err != nil {
+		t.Errorf("Undo failed: %v", err)
+	}
+
+	if items := sink.Items(); len(items) != 0 {
+		t.Errorf("Expected undo to delete every item by its mapped key, %v remain", len(items))
+	}
+}
+
+func TestStartRejectsKeysTheSinkIsNotKeyedOn(t *testing.T) {
+	config := newTestConfig()
+	config.Key = dp.KeySchema{HashKey: "pk", RangeKey: "sk"}
+	sink := dptest.NewMemorySink()
+	migration := NewMigrationFromProviders(config, newTestSource(), sink, dptest.NewMemoryStatus())
+
+	if err := runWithTimeout(t, migration.Start); err == nil {
+		t.Errorf("Expected migration to keys the sink is not keyed on to fail")
+	}
+
+	if items := sink.Items(); len(items) != 0 {
+		t.Errorf("Expected nothing to be written, got %v items", len(items))
+	}
+}
+
+func TestStartMigratesAllColumnsAndReportsUnmappedOnes(t *testing.T) {
+	source := newTestSource()
+	extra := newTestEntity("fff", "2")
+	extra.Properties["Extra"] = "surprise"
+	source.Add(extra)
+
+	named := NewMigrationFromProviders(newTestConfig(), source, dptest.NewMemorySink(), dptest.NewMemoryStatus())
+	if err := runWithTimeout(t, named.Start); err != nil {
+		t.Errorf("Migration failed: %v", err)
+	}
+
+	if columns, counts := named.Unmapped.Columns(); len(columns) != 1 || counts["Extra"] != 1 {
+		t.Errorf("Expected the unconfigured column to be reported once, got %v", counts)
+	}
+
+	config := newTestConfig()
+	config.TableStorage.ColumnNames = nil
+	config.Columns = dp.ColumnSelection{All: true, Exclude: []string{"Count"}}
+	sink := dptest.NewMemorySink()
+	all := NewMigrationFromProviders(config, source, sink, dptest.NewMemoryStatus())
+	if err := runWithTimeout(t, all.Start); err != nil {
+		t.Errorf("Migration failed: %v", err)
+	}
+
+	for _, item := range sink.Items() {
+		if item["Name"] == nil || item["Count"] != nil || (*item["PartitionKey"].S == "fff" && *item["RowKey"].S == "2" && item["Extra"] == nil) {
+			t.Errorf("Expected every column but Count to be migrated, got %v", item)
+		}
+	}
+
+	if columns, _ := all.Unmapped.Columns(); len(columns) != 0 {
+		t.Errorf("Expected no unmapped columns when migrating all of them, got %v", columns)
+	}
+}
+
+func TestStartConvertsColumnTypes(t *testing.T) {
+	source := newTestSource()
+	odd := newTestEntity("fff", "2")
+	odd.Properties["Count"] = "many"
+	source.Add(odd)
+
+	config := newTestConfig()
+	config.ColumnTypes = map[string]string{"Count": "n", "Name": "b"}
+	config.StrictTypes = true
+	sink := dptest.NewMemorySink()
+	status := dptest.NewMemoryStatus()
+	migration := NewMigrationFromProviders(config, source, sink, status)
+
+	if err := runWithTimeout(t, migration.Start); err == nil {
+		t.Errorf("Expected the entity whose count is not a number to fail the migration")
+	}
+
+	items := sink.Items()
+	if len(items) != 6 {
+		t.Errorf("Expected 6 migrated items, got %v", len(items))
+	}
+
+	for _, item := range items {
+		if item["Count"].N == nil || item["Name"].B == nil {
+			t.Errorf("Expected Count as a number and Name as binary, got %v", item)
+		}
+	}
+
+	if record, _ := status.Record(dp.NewQueryRange("8f", "g")); record.Status != dp.RangePartial || !strings.Contains(record.Error, "Count") {
+		t.Errorf("Expected range 8f to g to be partial because of Count, got %+v", record)
+	}
+}
+
+func TestStartTransformsItems(t *testing.T) {
+	config := newTestConfig()
+	config.Transforms = `[{"op": "rename", "column": "Name", "to": "Title"}, {"op": "template", "column": "Path", "value": "{PartitionKey}/{Title}"}]`
+	sink := dptest.NewMemorySink()
+	migration := NewMigrationFromProviders(config, newTestSource(), sink, dptest.NewMemoryStatus())
+
+	if err := runWithTimeout(t, migration.Start); err != nil {
+		t.Errorf("Migration failed: %v", err)
+	}
+
+	for _, item := range sink.Items() {
+		if item["Name"] != nil || item["Title"] == nil || *item["Path"].S != *item["PartitionKey"].S+"/"+*item["Title"].S {
+			t.Errorf("Expected Name renamed to Title and a Path built from it, got %v", item)
+		}
+	}
+
+	keyConfig := newTestConfig()
+	keyConfig.Transforms = `[{"op": "lower", "column": "PartitionKey"}]`
+	keyMigration := NewMigrationFromProviders(keyConfig, newTestSource(), dptest.NewMemorySink(), dptest.NewMemoryStatus())
+	if err := runWithTimeout(t, keyMigration.Start); err == nil {
+		t.Errorf("Expected a transform of a key attribute to be rejected")
+	}
+}
+
+func TestStartHandlesItemsTooBigForDynamo(t *testing.T) {
+	newSource := func() *dptest.MemorySource {
+		source := newTestSource()
+		large := newTestEntity("00a", "3")
+		large.Properties["Name"] = strings.Repeat("a", 500*1024)
+		source.Add(large)
+		return source
+	}
+
+	sink := dptest.NewMemorySink()
+	status := dptest.NewMemoryStatus()
+	migration := NewMigrationFromProviders(newTestConfig(), newSource(), sink, status)
+
+	if err := runWithTimeout(t, migration.Start); err == nil {
+		t.Errorf("Expected the item too big for dynamo to fail the migration")
+	}
+	if items := sink.Items(); len(items) != 6 {
+		t.Errorf("Expected the other items to be written, got %v", len(items))
+	}
+	if record, _ := status.Record(dp.NewQueryRange("00", "01")); record.Status != dp.RangePartial {
+		t.Errorf("Expected range 00 to 01 to be partial, got %+v", record)
+	}
+
+	dir, err := ioutil.TempDir("", "rejects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := newTestConfig()
+	config.LargeItems = dp.LargeItemPolicy{Strategy: "reject", RejectsFile: filepath.Join(dir, "rejects.jsonl")}
+	rejectSink := dptest.NewMemorySink()
+	rejectStatus := dptest.NewMemoryStatus()
+	rejecting := NewMigrationFromProviders(config, newSource(), rejectSink, rejectStatus)
+
+	if err := runWithTimeout(t, rejecting.Start); err == nil {
+		t.Errorf("Expected the rejected item to be reported as not migrated")
+	}
+	if items := rejectSink.Items(); len(items) != 6 {
+		t.Errorf("Expected the other items to be written, got %v", len(items))
+	}
+	if record, _ := rejectStatus.Record(dp.NewQueryRange("00", "01")); record.Status != dp.RangePartial || record.ItemsRejected != 1 || record.ItemsWritten != 2 {
+		t.Errorf("Expected range 00 to 01 to be partial with 1 rejected and 2 written entities, got %+v", record)
+	}
+	if contents, err := ioutil.ReadFile(config.LargeItems.RejectsFile); err != nil || strings.Count(string(contents), "\n") != 1 {
+		t.Errorf("Expected the item to be rejected to the rejects file, got %v", err)
+	}
+}
+
+func TestStartWritesTimestampInConfiguredFormat(t *testing.T) {
+	config := newTestConfig()
+	config.ColumnTimeFormats = map[string]string{"Timestamp": "epoch"}
+	config.TimestampName = "ModifiedAt"
+	sink := dptest.NewMemorySink()
+	migration := NewMigrationFromProviders(config, newTestSource(), sink, dptest.NewMemoryStatus())
+
+	if err := runWithTimeout(t, migration.Start); err != nil {
+		t.Errorf("Migration failed: %v", err)
+	}
+
+	for _, item := range sink.Items() {
+		if item["Timestamp"] != nil || item["ModifiedAt"] == nil || *item["ModifiedAt"].N != "1543622400" {
+			t.Errorf("Expected Timestamp as epoch seconds in ModifiedAt, got %v", item)
+		}
+	}
+
+	invalid := newTestConfig()
+	invalid.TimeFormat = "seconds"
+	invalidMigration := NewMigrationFromProviders(invalid, newTestSource(), dptest.NewMemorySink(), dptest.NewMemoryStatus())
+	if err := runWithTimeout(t, invalidMigration.Start); err == nil {
+		t.Errorf("Expected an unknown time format to be rejected")
+	}
+}
+
+func TestStartDerivesTTL(t *testing.T) {
+	config := newTestConfig()
+	config.TTL = dp.TTLPolicy{Attribute: "ExpiresAt", Retention: time.Hour}
+	sink := dptest.NewMemorySink()
+	migration := NewMigrationFromProviders(config, newTestSource(), sink, dptest.NewMemoryStatus())
+
+	if err := runWithTimeout(t, migration.Start); err != nil {
+		t.Errorf("Migration failed: %v", err)
+	}
+	for _, item := range sink.Items() {
+		if item["ExpiresAt"] == nil || *item["ExpiresAt"].N != "1543626000" {
+			t.Errorf("Expected an expiry an hour after Timestamp, got %v", item)
+		}
+	}
+
+	skipping := newTestConfig()
+	skipping.TTL = dp.TTLPolicy{Attribute: "ExpiresAt", Retention: time.Hour, SkipExpired: true}
+	skipSink := dptest.NewMemorySink()
+	status := dptest.NewMemoryStatus()
+	skipMigration := NewMigrationFromProviders(skipping, newTestSource(), skipSink, status)
+
+	if err := runWithTimeout(t, skipMigration.Start); err != nil {
+		t.Errorf("Migration failed: %v", err)
+	}
+	if items := skipSink.Items(); len(items) != 0 {
+		t.Errorf("Expected expired entities to be skipped, got %v items", len(items))
+	}
+	if skipMigration.TTL.Expired() != 6 {
+		t.Errorf("Expected 6 expired entities, got %v", skipMigration.TTL.Expired())
+	}
+	if record, _ := status.Record(dp.NewQueryRange("00", "01")); record.Status != dp.RangeCompleted {
+		t.Errorf("Expected range 00 to 01 to be completed, got %+v", record)
+	}
+
+	invalid := newTestConfig()
+	invalid.TTL = dp.TTLPolicy{Attribute: "RowKey"}
+	invalidMigration := NewMigrationFromProviders(invalid, newTestSource(), dptest.NewMemorySink(), dptest.NewMemoryStatus())
+	if err := runWithTimeout(t, invalidMigration.Start); err == nil {
+		t.Errorf("Expected an expiry overwriting a key attribute to be rejected")
+	}
+}
+
+func TestStartRequiresColumns(t *testing.T) {
+	config := newTestConfig()
+	config.TableStorage.ColumnNames = nil
+	migration := NewMigrationFromProviders(config, newTestSource(), dptest.NewMemorySink(), dptest.NewMemoryStatus())
+
+	if err := runWithTimeout(t, migration.Start); err == nil {
+		t.Errorf("Expected a migration without any columns to fail")
+	}
+}
+
+func TestRangesCoverKeySpace(t *testing.T) {
+	migration := NewMigrationFromProviders(newTestConfig(), newTestSource(), dptest.NewMemorySink(), dptest.NewMemoryStatus())
+	ranges, err := migration.ranges()
+
+	if err != nil {
+		t.Fatalf("Could not enumerate ranges: %v", err)
+	}
+
+	if len(ranges) != 32 {
+		t.Errorf("Expected 32 ranges, got %v", len(ranges))
+	}
+
+	if ranges[0].Ge != "00" || ranges[len(ranges)-1].Lt != "g" {
+		t.Errorf("Ranges do not span 00 to g: %v", ranges)
+	}
+
+	for i := 1; i < len(ranges); i++ {
+		if ranges[i].Ge != ranges[i-1].Lt {
+			t.Errorf("Gap between ranges %v and %v", ranges[i-1], ranges[i])
+		}
+	}
+}
+
+func TestStartMigratesKeysOfAnyAlphabet(t *testing.T) {
+	config := newTestConfig()
+	config.Ranges = []string{"1", "5", ":"}
+	config.KeyAlphabet = "decimal"
+	source := dptest.NewMemorySource(newTestEntity("10", "a"), newTestEntity("19", "a"), newTestEntity("4999", "a"), newTestEntity("5", "a"), newTestEntity("987", "a"))
+	sink := dptest.NewMemorySink()
+	migration := NewMigrationFromProviders(config, source, sink, dptest.NewMemoryStatus())
+
+	err := runWithTimeout(t, migration.Start)
+
+	if err != nil {
+		t.Errorf("Migration failed: %v", err)
+	}
+
+	if items := sink.Items(); len(items) != 5 {
+		t.Errorf("Expected 5 migrated items, got %v", len(items))
+	}
+}
+
+func TestStartRejectsInvalidAlphabet(t *testing.T) {
+	config := newTestConfig()
+	config.KeyAlphabet = "a/b"
+	migration := NewMigrationFromProviders(config, newTestSource(), dptest.NewMemorySink(), dptest.NewMemoryStatus())
+
+	if err := runWithTimeout(t, migration.Start); err == nil {
+		t.Errorf("Expected migration with an invalid key alphabet to fail")
+	}
+}
+
+func TestStartRetriesFailedReads(t *testing.T) {
+	source := &flakySource{MemorySource: newTestSource(), failingGe: "0f", failures: 2}
+	sink := dptest.NewMemorySink()
+	migration := NewMigrationFromProviders(newTestConfig(), source, sink, dptest.NewMemoryStatus())
+
+	err := runWithTimeout(t, migration.Start)
+
+	if err != nil {
+		t.Errorf("Expected range to succeed after retrying: %v", err)
+	}
+
+	if items := sink.Items(); len(items) != 6 {
+		t.Errorf("Expected 6 migrated items, got %v", len(items))
+	}
+}
+
+func TestStartReportsRangesThatKeepFailing(t *testing.T) {
+	source := &flakySource{MemorySource: newTestSource(), failingGe: "0f", failures: 3}
+	status := dptest.NewMemoryStatus()
+	migration := NewMigrationFromProviders(newTestConfig(), source, dptest.NewMemorySink(), status)
+
+	err := runWithTimeout(t, migration.Start)
+
+	if err == nil || !strings.Contains(err.Error(), "1 ranges") {
+		t.Errorf("Expected migration to fail with one range, got %v", err)
+	}
+
+	failed := migration.Failures.Ranges()
+	if len(failed) != 1 || failed[0].QueryRange != dp.NewQueryRange("0f", "80") {
+		t.Errorf("Expected range 0f to 80 to be reported as failed, got %v", failed)
+	}
+
+	if record, _ := status.Record(dp.NewQueryRange("0f", "80")); record.Status != dp.RangeFailed || record.Error != "server busy" {
+		t.Errorf("Expected range 0f to 80 to be recorded as failed, got %+v", record)
+	}
+}
+
+// partialSink fails to write every item with the given partition key
+type partialSink struct {
+	*dptest.MemorySink
+	failingPartitionKey string
+}
+
+func (sink *partialSink) WriteBatch(items []map[string]*dynamodb.AttributeValue) ([]map[string]*dynamodb.AttributeValue, error) {
+	written := []map[string]*dynamodb.AttributeValue{}
+	failed := []map[string]*dynamodb.AttributeValue{}
+	for _, item := range items {
+		if *item["PartitionKey"].S == sink.failingPartitionKey {
+			failed = append(failed, item)
+		} else {
+			written = append(written, item)
+		}
+	}
+
+	sink.MemorySink.WriteBatch(written)
+	if len(failed) > 0 {
+		return failed, dp.ErrUnprocessedItems
+	}
+	return nil, nil
+}
+
+func TestStartRecordsPartiallyWrittenRanges(t *testing.T) {
+	source := newTestSource()
+	source.Add(newTestEntity("fff", "2"))
+	sink := &partialSink{MemorySink: dptest.NewMemorySink(), failingPartitionKey: "a01"}
+	status := dptest.NewMemoryStatus()
+	migration := NewMigrationFromProviders(newTestConfig(), source, sink, status)
+
+	err := runWithTimeout(t, migration.Start)
+
+	if err == nil {
+		t.Errorf("Expected migration to report the partially written range")
+	}
+
+	if record, _ := status.Record(dp.NewQueryRange("8f", "g")); record.Status != dp.RangePartial || record.ItemsRead != 3 || record.ItemsWritten != 2 {
+		t.Errorf("Expected range 8f to g to be recorded as partial with 2 of 3 items written, got %+v", record)
+	}
+
+	if record, _ := status.Record(dp.NewQueryRange("00", "01")); record.Status != dp.RangeCompleted {
+		t.Errorf("Expected range 00 to 01 to be recorded as completed, got %v", record.Status)
+	}
+}
+
+func TestStartResumesRangesFromCheckpoints(t *testing.T) {
+	source := newHotSource()
+	status := dptest.NewMemoryStatus()
+	sink := &partialSink{MemorySink: dptest.NewMemorySink(), failingPartitionKey: "1f0"}
+	config := newTestConfig()
+	config.NumWorkers = 1
+	migration := NewMigrationFromProviders(config, source, sink, status)
+
+	runWithTimeout(t, migration.Start)
+
+	record, _ := status.Record(dp.NewQueryRange("0f", "80"))
+	if record.Status != dp.RangePartial || record.Checkpoint == nil || record.Checkpoint.NextPartitionKey > "1f0" {
+		t.Fatalf("Expected hot range to be partial with a checkpoint before the failed entity, got %+v", record)
+	}
+
+	retry := NewMigrationFromProviders(config, source, sink.MemorySink, status)
+	err := runWithTimeout(t, retry.Start)
+
+	if err != nil {
+		t.Errorf("Migration failed: %v", err)
+	}
+
+	if items := sink.Items(); len(items) != 46 {
+		t.Errorf("Expected 46 migrated items, got %v", len(items))
+	}
+
+	record, _ = status.Record(dp.NewQueryRange("0f", "80"))
+	if record.Status != dp.RangeCompleted || record.Attempt != 2 || record.ItemsRead >= 42 || record.Checkpoint != nil {
+		t.Errorf("Expected the second attempt to resume part way through the hot range, got %+v", record)
+	}
+}
@@ -0,0 +1,101 @@
+package migration
+
+import (
+	"fmt"
+	"log"
+	"sort"
+
+	dp "github.com/ImagineLearning/tablestorage-to-dynamo/internal/pkg/dataprovider"
+)
+
+// plannedRanges returns the ranges planned by an earlier run from the status table, or samples the source to plan
+// them and records them as planned. Keeping the plan in the status table lets restarted and concurrent processes
+// work on the same ranges even though samples of a live table change over time. A plan is only reused if it covers
+// the key space of RANGES without gaps, so records of other jobs and plans cut short by a crash are planned again.
+func (migration *Migration) plannedRanges(spec dp.RangeSpec) ([]dp.QueryRange, error) {
+	grid, err := dp.GenerateRanges(spec)
+	if err != nil || len(grid) == 0 {
+		return grid, err
+	}
+	span := dp.NewQueryRange(grid[0].Ge, grid[len(grid)-1].Lt)
+
+	records := migration.Status.ScanStatusTable()
+	if ranges, ok := reusablePlan(splitRoots(records), span); ok {
+		log.Printf("Reusing plan of %v ranges from the status table", len(ranges))
+		return ranges, nil
+	} else if len(records) > 0 {
+		log.Printf("Status table holds no complete plan of ge: %v and lt: %v, planning again", span.Ge, span.Lt)
+	}
+
+	sampler, ok := migration.Source.(dp.KeySampler)
+	if !ok {
+		return nil, fmt.Errorf("source can't be sampled to plan ranges")
+	}
+
+	ranges, err := dp.PlanRanges(sampler, dp.PlanSpec{
+		RangeSpec:   spec,
+		TargetItems: migration.Config.TargetRangeItems,
+		SampleSize:  migration.Config.SampleSize,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not plan ranges: %v", err)
+	}
+
+	// ranges an earlier plan shares with this one keep their records, they may have been migrated already
+	previous := indexRecords(records)
+	for _, queryRange := range ranges {
+		if _, found := previous[queryRange]; !found {
+			migration.Status.WriteRangeRecord(dp.NewRangeRecord(queryRange, dp.RangePlanned))
+		}
+	}
+
+	log.Printf("Planned %v ranges of about %v items", len(ranges), migration.Config.TargetRangeItems)
+	return ranges, nil
+}
+
+// fromPlan reports whether a record of status can be part of a plan, i.e. it was planned and may have been worked
+// on since. Records written before statuses were tracked predate planning.
+func fromPlan(status dp.RangeStatus) bool {
+	switch status {
+	case dp.RangePlanned, dp.RangeLeased, dp.RangeIncomplete, dp.RangeCompleted, dp.RangePartial, dp.RangeFailed, dp.RangeSplit:
+		return true
+	}
+	return false
+}
+
+// reusablePlan returns ranges of records that follow each other without gaps from the start to the end of span, and
+// whether records form such a plan at all. Records outside span are left out. Records may overlap when a plan cut
+// short was planned again, the first chain of them that covers span is taken.
+func reusablePlan(records []dp.RangeRecord, span dp.QueryRange) ([]dp.QueryRange, bool) {
+	byGe := map[string][]dp.QueryRange{}
+	for _, record := range records {
+		if fromPlan(record.Status) && record.Ge >= span.Ge && record.Lt <= span.Lt && record.Ge < record.Lt {
+			byGe[record.Ge] = append(byGe[record.Ge], record.QueryRange)
+		}
+	}
+	for _, ranges := range byGe {
+		sort.Slice(ranges, func(i, j int) bool { return ranges[i].Lt < ranges[j].Lt })
+	}
+
+	// depth first from the start of span, remembering bounds no plan continues from
+	deadEnds := map[string]bool{}
+	var cover func(ge string) ([]dp.QueryRange, bool)
+	cover = func(ge string) ([]dp.QueryRange, bool) {
+		if ge == span.Lt {
+			return []dp.QueryRange{}, true
+		}
+		if deadEnds[ge] {
+			return nil, false
+		}
+
+		for _, queryRange := range byGe[ge] {
+			if rest, ok := cover(queryRange.Lt); ok {
+				return append([]dp.QueryRange{queryRange}, rest...), true
+			}
+		}
+		deadEnds[ge] = true
+		return nil, false
+	}
+
+	return cover(span.Ge)
+}
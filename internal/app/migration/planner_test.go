@@ -0,0 +1,116 @@
+package migration
+
+import (
+	"testing"
+
+	dp "github.com/ImagineLearning/tablestorage-to-dynamo/internal/pkg/dataprovider"
+	"github.com/ImagineLearning/tablestorage-to-dynamo/internal/pkg/dataprovider/dptest"
+)
+
+func TestStartMigratesPlannedRanges(t *testing.T) {
+	config := newTestConfig()
+	config.TargetRangeItems = 2
+	config.SampleSize = 10
+	sink := dptest.NewMemorySink()
+	status := dptest.NewMemoryStatus()
+	migration := NewMigrationFromProviders(config, newTestSource(), sink, status)
+
+	err := runWithTimeout(t, migration.Start)
+
+	if err != nil {
+		t.Errorf("Migration failed: %v", err)
+	}
+
+	if items := sink.Items(); len(items) != 6 {
+		t.Errorf("Expected 6 migrated items, got %v", len(items))
+	}
+
+	records := status.ScanStatusTable()
+	if len(records) < 3 || len(records) >= 32 {
+		t.Errorf("Expected a few ranges of about 2 items, got %v", len(records))
+	}
+
+	for _, record := range records {
+		if record.Status != dp.RangeCompleted || record.ItemsRead > 2 {
+			t.Errorf("Expected planned range to be completed with at most 2 items, got %+v", record)
+		}
+	}
+}
+
+func TestStartReusesPlanFromStatusTable(t *testing.T) {
+	config := newTestConfig()
+	config.TargetRangeItems = 100
+	status := dptest.NewMemoryStatus(
+		dp.NewRangeRecord(dp.NewQueryRange("00", "3"), dp.RangeCompleted),
+		dp.NewRangeRecord(dp.NewQueryRange("3", "g"), dp.RangePlanned),
+	)
+	sink := dptest.NewMemorySink()
+	migration := NewMigrationFromProviders(config, newTestSource(), sink, status)
+
+	err := runWithTimeout(t, migration.Start)
+
+	if err != nil {
+		t.Errorf("Migration failed: %v", err)
+	}
+
+	if items := sink.Items(); len(items) != 4 {
+		t.Errorf("Expected only the 4 items of the planned range to be migrated, got %v", len(items))
+	}
+
+	if records := status.ScanStatusTable(); len(records) != 2 {
+		t.Errorf("Expected the plan to be reused, got %v ranges", len(records))
+	}
+}
+
+func TestStartPlansAgainWhenStatusTableHoldsNoCompletePlan(t *testing.T) {
+	cases := map[string][]dp.RangeRecord{
+		"unplanned run": {dp.NewRangeRecord(dp.NewQueryRange("00", "01"), dp.RangeCompleted)},
+		"cut short":     {dp.NewRangeRecord(dp.NewQueryRange("00", "3"), dp.RangePlanned)},
+		"other job":     {dp.NewRangeRecord(dp.NewQueryRange("0", "g"), dp.RangeCompleted), dp.NewRangeRecord(dp.NewQueryRange("g", "z"), dp.RangePlanned)},
+	}
+
+	for name, records := range cases {
+		config := newTestConfig()
+		config.TargetRangeItems = 2
+		config.SampleSize = 10
+		config.Ranges = []string{"00", "g"}
+		config.RangePrecision = 1
+		sink := dptest.NewMemorySink()
+		migration := NewMigrationFromProviders(config, newTestSource(), sink, dptest.NewMemoryStatus(records...))
+
+		if err := runWithTimeout(t, migration.Start); err != nil {
+			t.Errorf("%v: migration failed: %v", name, err)
+		}
+
+		if items := sink.Items(); len(items) != 6 {
+			t.Errorf("%v: expected the key space to be planned again and all 6 items migrated, got %v", name, len(items))
+		}
+	}
+}
+
+func TestStartReusesPlanCoveringRanges(t *testing.T) {
+	config := newTestConfig()
+	config.TargetRangeItems = 100
+	config.Ranges = []string{"0", "8"}
+	config.RangePrecision = 1
+	status := dptest.NewMemoryStatus(
+		dp.NewRangeRecord(dp.NewQueryRange("0", "1"), dp.RangeCompleted),
+		dp.NewRangeRecord(dp.NewQueryRange("0", "2"), dp.RangeCompleted),
+		dp.NewRangeRecord(dp.NewQueryRange("2", "8"), dp.RangePlanned),
+		dp.NewRangeRecord(dp.NewQueryRange("8", "g"), dp.RangePlanned),
+	)
+	sink := dptest.NewMemorySink()
+	migration := NewMigrationFromProviders(config, newTestSource(), sink, status)
+
+	if err := runWithTimeout(t, migration.Start); err != nil {
+		t.Errorf("Migration failed: %v", err)
+	}
+
+	if items := sink.Items(); len(items) != 1 {
+		t.Errorf("Expected only the item of range 2 to 8 to be migrated, got %v", len(items))
+	}
+
+	if record, _ := status.Record(dp.NewQueryRange("8", "g")); record.Status != dp.RangePlanned {
+		t.Errorf("Expected the range of another job to be left alone, got %+v", record)
+	}
+}
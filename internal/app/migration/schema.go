@@ -0,0 +1,106 @@
+package migration
+
+import (
+	"context"
+	"fmt"
+
+	dp "github.com/ImagineLearning/tablestorage-to-dynamo/internal/pkg/dataprovider"
+	"github.com/kelseyhightower/envconfig"
+)
+
+// SchemaConfig represents the config values needed to infer the schema of a table
+type SchemaConfig struct {
+	TableStorage   dp.TableStorageConfig
+	Ranges         []string `required:"true"`
+	RangePrecision int      `default:"3"`
+	KeyAlphabet    string   `default:"hex-lower"`
+	SampleSize     int      `default:"1000"` // entities read from every range, 0 reads all of them
+}
+
+// LoadSchemaConfig loads the schema configuration values from the same env vars as the migration
+func LoadSchemaConfig() (SchemaConfig, error) {
+	var config SchemaConfig
+	err := envconfig.Process("", &config)
+	return config, err
+}
+
+// InferSchema reads up to SampleSize entities from every range of source and reports the columns and types found
+// until ctx is cancelled
+func InferSchema(ctx context.Context, source dp.Source, config SchemaConfig) (*dp.SchemaReport, error) {
+	spec, err := newRangeSpec(config.Ranges, config.RangePrecision, config.KeyAlphabet)
+	if err != nil {
+		return nil, err
+	}
+
+	ranges, err := source.Ranges(spec)
+	if err != nil {
+		return nil, fmt.Errorf("could not enumerate ranges to sample: %v", err)
+	}
+
+	report := dp.NewSchemaReport()
+	for _, queryRange := range ranges {
+		read := 0
+		next := dp.Continuation{}
+
+		for ctx.Err() == nil && (config.SampleSize <= 0 || read < config.SampleSize) {
+			entities, following, err := source.ReadPage(queryRange, next)
+			if err != nil {
+				return nil, fmt.Errorf("could not read range ge: %v and lt: %v: %v", queryRange.Ge, queryRange.Lt, err)
+			}
+
+			for _, entity := range entities {
+				if config.SampleSize > 0 && read >= config.SampleSize {
+					break
+				}
+				report.Add(entity)
+				read++
+			}
+
+			next = following
+			if next.IsZero() {
+				break
+			}
+		}
+	}
+
+	report.Finish()
+	return report, ctx.Err()
+}
+
+// loadMappingFile fills the column names, types, transforms and time formats of config from its mapping file.
+// Settings in env vars win over the file.
+func loadMappingFile(config *Config) error {
+	if config.MappingFile == "" {
+		return nil
+	}
+
+	mapping, err := dp.LoadMappingFile(config.MappingFile)
+	if err != nil {
+		return err
+	}
+
+	if len(config.TableStorage.ColumnNames) == 0 {
+		config.TableStorage.ColumnNames = mapping.ColumnNames
+	}
+
+	if config.Transforms == "" {
+		config.Transforms = string(mapping.Transforms)
+	}
+
+	config.ColumnTypes = mergeColumns(config.ColumnTypes, mapping.ColumnTypes)
+	config.ColumnTimeFormats = mergeColumns(config.ColumnTimeFormats, mapping.TimeFormats)
+	return nil
+}
+
+// mergeColumns adds the per column settings of file that are not set in env
+func mergeColumns(env map[string]string, file map[string]string) map[string]string {
+	for column, value := range file {
+		if _, set := env[column]; !set {
+			if env == nil {
+				env = map[string]string{}
+			}
+			env[column] = value
+		}
+	}
+	return env
+}
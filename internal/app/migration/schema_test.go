@@ -0,0 +1,109 @@
+package migration
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ImagineLearning/tablestorage-to-dynamo/internal/pkg/dataprovider/dptest"
+)
+
+func newSchemaTestConfig() SchemaConfig {
+	return SchemaConfig{Ranges: []string{"0", "8", "g"}, RangePrecision: 2, KeyAlphabet: "hex-lower"}
+}
+
+func TestInferSchemaReportsColumnsAndTypes(t *testing.T) {
+	source := newTestSource()
+	mixed := newTestEntity("fff", "2")
+	mixed.Properties["Count"] = "many"
+	mixed.Properties["Note"] = ""
+	source.Add(mixed)
+
+	report, err := InferSchema(context.Background(), source, newSchemaTestConfig())
+
+	if err != nil {
+		t.Fatalf("Could not infer schema: %v", err)
+	}
+
+	if report.Entities != 7 || fmt.Sprint(report.ColumnNames) != "[Count Name Note]" {
+		t.Errorf("Expected 3 columns on 7 entities, got %v on %v", report.ColumnNames, report.Entities)
+	}
+
+	count := report.Columns[0]
+	if count.EdmTypes["Edm.Int64"] != 6 || count.EdmTypes["Edm.String"] != 1 || report.ColumnTypes["Count"] != "S" {
+		t.Errorf("Expected Count to be found as Edm.Int64 and Edm.String and mapped to S, got %+v and %v", count, report.ColumnTypes)
+	}
+
+	note := report.Columns[2]
+	if note.Entities != 1 || note.Empty != 1 || note.NullRate != 6.0/7 {
+		t.Errorf("Expected Note to be empty on the one entity that has it, got %+v", note)
+	}
+
+	if report.ItemSizes.Max == 0 || report.ItemSizes.Average == 0 || report.ItemSizes.OverLimit != 0 {
+		t.Errorf("Expected item sizes to be estimated, got %+v", report.ItemSizes)
+	}
+}
+
+func TestInferSchemaSamplesEveryRange(t *testing.T) {
+	config := newSchemaTestConfig()
+	config.SampleSize = 1
+
+	report, err := InferSchema(context.Background(), newHotSource(), config)
+
+	if err != nil {
+		t.Fatalf("Could not infer schema: %v", err)
+	}
+
+	// 00 to 01, the hot range 0f to 80 and 8f to g hold entities
+	if report.Entities != 3 {
+		t.Errorf("Expected one entity from every range, got %v", report.Entities)
+	}
+}
+
+func TestMigrationLoadsSchemaReportAsMappingFile(t *testing.T) {
+	source := newTestSource()
+	mixed := newTestEntity("fff", "2")
+	mixed.Properties["Count"] = "many"
+	source.Add(mixed)
+
+	report, _ := InferSchema(context.Background(), source, newSchemaTestConfig())
+	contents, _ := json.Marshal(report)
+
+	dir, err := ioutil.TempDir("", "schema")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "schema.json")
+	ioutil.WriteFile(path, contents, 0644)
+
+	config := newTestConfig()
+	config.TableStorage.ColumnNames = nil
+	config.ColumnTypes = map[string]string{"Name": "B"}
+	config.MappingFile = path
+
+	if err := loadMappingFile(&config); err != nil {
+		t.Fatalf("Could not load mapping file: %v", err)
+	}
+
+	if fmt.Sprint(config.TableStorage.ColumnNames) != "[Count Name]" || config.ColumnTypes["Count"] != "S" || config.ColumnTypes["Name"] != "B" {
+		t.Errorf("Expected columns and types from the report without overriding env vars, got %v and %v", config.TableStorage.ColumnNames, config.ColumnTypes)
+	}
+
+	sink := dptest.NewMemorySink()
+	migration := NewMigrationFromProviders(config, source, sink, dptest.NewMemoryStatus())
+	if err := runWithTimeout(t, migration.Start); err != nil {
+		t.Errorf("Migration failed: %v", err)
+	}
+
+	for _, item := range sink.Items() {
+		if item["Count"] == nil || item["Count"].S == nil {
+			t.Errorf("Expected Count to be migrated as a string, got %v", item)
+		}
+	}
+}
@@ -1,16 +1,32 @@
 package migration
 
 import (
+	"log"
 	"os"
 	"testing"
 )
 
 var (
-	config Config
+	config     Config
+	configured bool
 )
 
+// requireCloud skips tests that talk to real table storage and dynamo when their env vars are missing.
+func requireCloud(t *testing.T) {
+	if !configured {
+		t.Skip("table storage and dynamo env vars are not configured")
+	}
+}
+
 func TestMain(m *testing.M) {
-	config = LoadMigrationConfig()
+	var err error
+	config, err = loadConfig()
+
+	if err != nil {
+		log.Printf("Skipping integration tests: %v", err)
+	}
+	configured = err == nil
+
 	retCode := m.Run()
 	os.Exit(retCode)
 }
@@ -0,0 +1,182 @@
+package migration
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	dp "github.com/ImagineLearning/tablestorage-to-dynamo/internal/pkg/dataprovider"
+)
+
+// ErrInterrupted is returned when a migration is shut down before every range has been dispatched and finished.
+// Ranges it did not get to are picked up by the next run.
+var ErrInterrupted = errors.New("migration interrupted before every range was migrated")
+
+var errShutdown = errors.New("interrupted by shutdown")
+
+// ShutdownContext returns a context that is cancelled once the process receives SIGTERM or an interrupt, which is
+// how Kubernetes asks a pod to stop, and a function that stops listening for them
+func ShutdownContext() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+
+	go func() {
+		select {
+		case <-signals:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(signals)
+		cancel()
+	}
+}
+
+// inFlightRanges is the status store handed to workers. It keeps track of the ranges that have been dispatched but
+// have no final record yet, so they can be recorded as incomplete when the migration shuts down. finished is called
+// with every range that gets its final record.
+type inFlightRanges struct {
+	dp.StatusStore
+
+	mutex    sync.Mutex
+	tasks    map[dp.QueryRange]dp.ReadTask
+	finished func(queryRange dp.QueryRange)
+}
+
+func newInFlightRanges(status dp.StatusStore, finished func(queryRange dp.QueryRange)) *inFlightRanges {
+	return &inFlightRanges{StatusStore: status, tasks: map[dp.QueryRange]dp.ReadTask{}, finished: finished}
+}
+
+func (inFlight *inFlightRanges) add(task dp.ReadTask) {
+	inFlight.mutex.Lock()
+	defer inFlight.mutex.Unlock()
+
+	inFlight.tasks[task.QueryRange] = task
+}
+
+// WriteRangeRecord stores the record and forgets its range. Holding the lock while writing keeps a worker finishing
+// late from racing recordIncomplete.
+func (inFlight *inFlightRanges) WriteRangeRecord(record dp.RangeRecord) {
+	inFlight.mutex.Lock()
+	defer inFlight.mutex.Unlock()
+
+	delete(inFlight.tasks, record.QueryRange)
+	inFlight.StatusStore.WriteRangeRecord(record)
+	inFlight.finished(record.QueryRange)
+}
+
+// CheckpointRange stores the checkpoint and remembers it for the range in flight, so an incomplete record keeps it
+func (inFlight *inFlightRanges) CheckpointRange(record dp.RangeRecord) error {
+	inFlight.mutex.Lock()
+	defer inFlight.mutex.Unlock()
+
+	if task, found := inFlight.tasks[record.QueryRange]; found {
+		task.From = record.Resume()
+		task.Rejected = record.RejectedBefore()
+		inFlight.tasks[record.QueryRange] = task
+	}
+	return inFlight.StatusStore.CheckpointRange(record)
+}
+
+// recordIncomplete writes an incomplete record for every range still in flight and returns how many there were
+func (inFlight *inFlightRanges) recordIncomplete(identity dp.Identity) int {
+	inFlight.mutex.Lock()
+	defer inFlight.mutex.Unlock()
+
+	count := len(inFlight.tasks)
+	for queryRange, task := range inFlight.tasks {
+		record := dp.RangeRecord{QueryRange: queryRange, Attempt: task.Attempt, LeaseOwner: task.LeaseOwner}
+		if !task.From.IsZero() {
+			from := task.From
+			record.Checkpoint = &from
+			record.ItemsRejected = task.Rejected
+		}
+		record.Start(identity)
+		record.Finish(dp.RangeIncomplete, errShutdown)
+		inFlight.StatusStore.WriteRangeRecord(record)
+		delete(inFlight.tasks, queryRange)
+		inFlight.finished(queryRange)
+	}
+	return count
+}
+
+// dispatch queues task for the read workers unless ctx is cancelled first. A task that could not be queued stays in
+// flight, a lease on it is released when the migration records its in-flight ranges as incomplete.
+func (migration *Migration) dispatch(ctx context.Context, task dp.ReadTask) bool {
+	migration.track(task)
+	return migration.queue(ctx, task)
+}
+
+// track counts task as in flight until its range has a record
+func (migration *Migration) track(task dp.ReadTask) {
+	migration.inFlight.add(task)
+	migration.WaitGrp.Add(1)
+}
+
+// queue hands a tracked task to the read workers unless ctx is cancelled first
+func (migration *Migration) queue(ctx context.Context, task dp.ReadTask) bool {
+	if ctx.Err() != nil {
+		migration.WaitGrp.Done()
+		return false
+	}
+
+	select {
+	case migration.ReadWorkQueue <- task:
+		return true
+	case <-ctx.Done():
+		migration.WaitGrp.Done()
+		return false
+	}
+}
+
+// drainReadWork drops read work no worker has picked up yet
+func (migration *Migration) drainReadWork() {
+	for {
+		select {
+		case <-migration.ReadWorkQueue:
+			migration.WaitGrp.Done()
+		default:
+			return
+		}
+	}
+}
+
+// workDone returns a channel that is closed once all dispatched work has finished
+func (migration *Migration) workDone() <-chan bool {
+	done := make(chan bool)
+	go func() {
+		migration.WaitGrp.Wait()
+		close(done)
+	}()
+	return done
+}
+
+// wait waits for all dispatched work. Once ctx is cancelled queued work is dropped and work in flight gets
+// ShutdownGracePeriod to finish. It reports whether the migration was interrupted.
+func (migration *Migration) wait(ctx context.Context) bool {
+	done := migration.workDone()
+
+	select {
+	case <-done:
+		return false
+	case <-ctx.Done():
+	}
+
+	migration.drainReadWork()
+	log.Printf("Shutting down, waiting up to %v for ranges in flight", migration.Config.ShutdownGracePeriod)
+
+	select {
+	case <-done:
+	case <-time.After(migration.Config.ShutdownGracePeriod):
+		log.Printf("Shutdown grace period ended with ranges still in flight")
+	}
+	return true
+}
@@ -0,0 +1,145 @@
+package migration
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	dp "github.com/ImagineLearning/tablestorage-to-dynamo/internal/pkg/dataprovider"
+	"github.com/ImagineLearning/tablestorage-to-dynamo/internal/pkg/dataprovider/dptest"
+)
+
+// blockingSource blocks reads of the range starting with blockedGe until release is closed
+type blockingSource struct {
+	*dptest.MemorySource
+	blockedGe string
+	started   chan bool
+	release   chan bool
+}
+
+func newBlockingSource(blockedGe string) *blockingSource {
+	return &blockingSource{
+		MemorySource: newTestSource(),
+		blockedGe:    blockedGe,
+		started:      make(chan bool, 1),
+		release:      make(chan bool),
+	}
+}
+
+func (source *blockingSource) ReadPage(queryRange dp.QueryRange, from dp.Continuation) ([]*storage.Entity, dp.Continuation, error) {
+	if queryRange.Ge == source.blockedGe {
+		source.started <- true
+		<-source.release
+	}
+	return source.MemorySource.ReadPage(queryRange, from)
+}
+
+// startAndCancel starts migration and cancels it once source has started reading its blocked range
+func startAndCancel(t *testing.T, migration Migration, source *blockingSource) error {
+	return runWithTimeout(t, func(ctx context.Context) error {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		go func() {
+			<-source.started
+			cancel()
+		}()
+		return migration.Start(ctx)
+	})
+}
+
+func TestShutdownRecordsRangesInFlightAsIncomplete(t *testing.T) {
+	config := newTestConfig()
+	config.ShutdownGracePeriod = 50 * time.Millisecond
+	source := newBlockingSource("0f")
+	defer close(source.release)
+	sink := dptest.NewMemorySink()
+	status := dptest.NewMemoryStatus()
+	migration := NewMigrationFromProviders(config, source, sink, status)
+
+	err := startAndCancel(t, migration, source)
+
+	if err != ErrInterrupted {
+		t.Errorf("Expected migration to be interrupted, got %v", err)
+	}
+
+	record, _ := status.Record(dp.NewQueryRange("0f", "80"))
+	if record.Status != dp.RangeIncomplete || record.Attempt != 1 || record.Host == "" {
+		t.Errorf("Expected range in flight to be recorded as incomplete, got %+v", record)
+	}
+
+	resumed := NewMigrationFromProviders(newTestConfig(), newTestSource(), sink, status)
+	err = runWithTimeout(t, resumed.Start)
+
+	if err != nil {
+		t.Errorf("Resumed migration failed: %v", err)
+	}
+
+	if items := sink.Items(); len(items) != 6 {
+		t.Errorf("Expected 6 migrated items after resuming, got %v", len(items))
+	}
+
+	if record, _ := status.Record(dp.NewQueryRange("0f", "80")); record.Status != dp.RangeCompleted || record.Attempt != 2 {
+		t.Errorf("Expected incomplete range to be completed on the second attempt, got %+v", record)
+	}
+}
+
+func TestShutdownLetsRangesInFlightFinishWithinGracePeriod(t *testing.T) {
+	config := newTestConfig()
+	config.ShutdownGracePeriod = 5 * time.Second
+	source := newBlockingSource("0f")
+	status := dptest.NewMemoryStatus()
+	migration := NewMigrationFromProviders(config, source, dptest.NewMemorySink(), status)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(source.release)
+	}()
+	err := startAndCancel(t, migration, source)
+
+	if err != ErrInterrupted {
+		t.Errorf("Expected migration to be interrupted, got %v", err)
+	}
+
+	if record, _ := status.Record(dp.NewQueryRange("0f", "80")); record.Status != dp.RangeCompleted {
+		t.Errorf("Expected range in flight to finish within the grace period, got %+v", record)
+	}
+}
+
+func TestShutdownReleasesLeasedRanges(t *testing.T) {
+	config := newLeaseTestConfig()
+	config.LeaseDuration = time.Minute
+	config.ShutdownGracePeriod = 50 * time.Millisecond
+	source := newBlockingSource("0f")
+	defer close(source.release)
+	status := dptest.NewMemoryStatus()
+	migration := NewMigrationFromProviders(config, source, dptest.NewMemorySink(), status)
+
+	err := startAndCancel(t, migration, source)
+
+	if err != ErrInterrupted {
+		t.Errorf("Expected migration to be interrupted, got %v", err)
+	}
+
+	record, _ := status.Record(dp.NewQueryRange("0f", "80"))
+	if !record.Claimable(time.Now(), config.MaxRangeAttempts) {
+		t.Errorf("Expected range in flight to be claimable by the next pod, got %+v", record)
+	}
+}
+
+func TestShutdownContextIsCancelledBySIGTERM(t *testing.T) {
+	ctx, stop := ShutdownContext()
+	defer stop()
+
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatalf("Could not send SIGTERM: %v", err)
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected SIGTERM to cancel the context")
+	}
+}
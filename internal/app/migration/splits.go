@@ -0,0 +1,86 @@
+package migration
+
+import (
+	"context"
+	"log"
+
+	dp "github.com/ImagineLearning/tablestorage-to-dynamo/internal/pkg/dataprovider"
+)
+
+// splitPolicy returns the configured split policy, splitting ranges in the alphabet ranges are generated from
+func (migration *Migration) splitPolicy() (dp.SplitPolicy, error) {
+	spec, err := migration.rangeSpec()
+	split := migration.Config.Split
+	split.Alphabet = spec.Alphabet
+	return split, err
+}
+
+// expandSplits replaces every range that has been split with its children, recursively, so children that have not
+// been migrated yet are picked up again
+func expandSplits(ranges []dp.QueryRange, records map[dp.QueryRange]dp.RangeRecord) []dp.QueryRange {
+	expanded := make([]dp.QueryRange, 0, len(ranges))
+	for _, queryRange := range ranges {
+		if record, found := records[queryRange]; found && record.Status == dp.RangeSplit {
+			expanded = append(expanded, expandSplits(record.Children, records)...)
+		} else {
+			expanded = append(expanded, queryRange)
+		}
+	}
+	return expanded
+}
+
+// splitRoots drops the children of split ranges from records, leaving the ranges that were planned or enumerated
+func splitRoots(records []dp.RangeRecord) []dp.RangeRecord {
+	children := map[dp.QueryRange]bool{}
+	for _, record := range records {
+		for _, child := range record.Children {
+			children[child] = true
+		}
+	}
+
+	roots := make([]dp.RangeRecord, 0, len(records))
+	for _, record := range records {
+		if !children[record.QueryRange] {
+			roots = append(roots, record)
+		}
+	}
+	return roots
+}
+
+// dispatchChildren returns the function read workers hand the children of a split range to. The first child stays
+// with the read worker, the others are dispatched. In lease mode every child is claimed first so no other process
+// reads it too. Children are tracked right away but queued in the background, the read worker splitting the range
+// may be the one the read work queue is waiting for.
+func (migration *Migration) dispatchChildren(ctx context.Context) func(children []dp.QueryRange) {
+	return func(children []dp.QueryRange) {
+		tasks := make([]dp.ReadTask, 0, len(children))
+
+		for i, child := range children {
+			if migration.Config.LeaseRanges {
+				_, ok, err := migration.Status.ClaimRange(child, migration.Identity, migration.leaseExpiry(), migration.Config.MaxRangeAttempts)
+				if err != nil || !ok {
+					log.Printf("Could not claim range ge: %v and lt: %v split off a bigger range: %v", child.Ge, child.Lt, err)
+					continue
+				}
+				migration.leases.add(child, false)
+			}
+
+			if i == 0 {
+				continue
+			}
+
+			task := dp.ReadTask{QueryRange: child, Attempt: 1}
+			if migration.Config.LeaseRanges {
+				task.LeaseOwner = migration.Identity.Owner()
+			}
+			migration.track(task)
+			tasks = append(tasks, task)
+		}
+
+		go func() {
+			for _, task := range tasks {
+				migration.queue(ctx, task)
+			}
+		}()
+	}
+}
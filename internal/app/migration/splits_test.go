@@ -0,0 +1,114 @@
+package migration
+
+import (
+	"fmt"
+	"testing"
+
+	dp "github.com/ImagineLearning/tablestorage-to-dynamo/internal/pkg/dataprovider"
+	"github.com/ImagineLearning/tablestorage-to-dynamo/internal/pkg/dataprovider/dptest"
+)
+
+// newHotSource returns the test source with 40 more entities in the range 0f to 80, read two per page
+func newHotSource() *dptest.MemorySource {
+	source := newTestSource()
+	source.PageSize = 2
+	for i := 0; i < 40; i++ {
+		source.Add(newTestEntity(fmt.Sprintf("%03x", 0x100+i*40), "1"))
+	}
+	return source
+}
+
+func TestStartSplitsHotRanges(t *testing.T) {
+	config := newTestConfig()
+	config.Split = dp.SplitPolicy{MaxPages: 3, Children: 2}
+	sink := dptest.NewMemorySink()
+	status := dptest.NewMemoryStatus()
+	migration := NewMigrationFromProviders(config, newHotSource(), sink, status)
+
+	err := runWithTimeout(t, migration.Start)
+
+	if err != nil {
+		t.Errorf("Migration failed: %v", err)
+	}
+
+	if items := sink.Items(); len(items) != 46 {
+		t.Errorf("Expected 46 migrated items, got %v", len(items))
+	}
+
+	parent, _ := status.Record(dp.NewQueryRange("0f", "80"))
+	if parent.Status != dp.RangeSplit || len(parent.Children) != 3 || parent.Children[0].Ge != "0f" {
+		t.Fatalf("Expected hot range to be split into 3 children, got %+v", parent)
+	}
+
+	records := indexRecords(status.ScanStatusTable())
+	leaves := expandSplits([]dp.QueryRange{parent.QueryRange}, records)
+	read := 0
+	for _, leaf := range leaves {
+		record := records[leaf]
+		if record.Status != dp.RangeCompleted {
+			t.Errorf("Expected child range to be completed, got %+v", record)
+		}
+		read += record.ItemsRead
+	}
+
+	if len(leaves) <= 3 || read != 42 {
+		t.Errorf("Expected the 42 items of the hot range to be read by more than 3 ranges, got %v in %v", read, len(leaves))
+	}
+}
+
+func TestStartResumesChildrenOfSplitRanges(t *testing.T) {
+	parent := dp.NewRangeRecord(dp.NewQueryRange("0f", "80"), dp.RangeSplit)
+	parent.Children = []dp.QueryRange{dp.NewQueryRange("0f", "3"), dp.NewQueryRange("3", "80")}
+	status := dptest.NewMemoryStatus(parent, dp.NewRangeRecord(dp.NewQueryRange("0f", "3"), dp.RangeCompleted))
+	migration := NewMigrationFromProviders(newTestConfig(), newTestSource(), dptest.NewMemorySink(), status)
+
+	err := runWithTimeout(t, migration.Start)
+
+	if err != nil {
+		t.Errorf("Migration failed: %v", err)
+	}
+
+	if record, _ := status.Record(dp.NewQueryRange("3", "80")); record.Status != dp.RangeCompleted || record.ItemsRead != 2 {
+		t.Errorf("Expected unfinished child to be migrated, got %+v", record)
+	}
+
+	if record, _ := status.Record(dp.NewQueryRange("0f", "80")); record.Status != dp.RangeSplit {
+		t.Errorf("Expected split range not to be migrated again, got %+v", record)
+	}
+}
+
+func TestLeasedMigrationClaimsChildrenOfSplitRanges(t *testing.T) {
+	config := newLeaseTestConfig()
+	config.Split = dp.SplitPolicy{MaxPages: 3, Children: 2}
+	source := newHotSource()
+	sink := dptest.NewMemorySink()
+	status := dptest.NewMemoryStatus()
+
+	first := NewMigrationFromProviders(config, source, sink, status)
+	first.Identity = dp.Identity{JobID: "test-job", Host: "pod-1"}
+	second := NewMigrationFromProviders(config, source, sink, status)
+	second.Identity = dp.Identity{JobID: "test-job", Host: "pod-2"}
+
+	errs := make(chan error, 2)
+	go func() { errs <- runWithTimeout(t, first.Start) }()
+	go func() { errs <- runWithTimeout(t, second.Start) }()
+
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("Leased migration failed: %v", err)
+		}
+	}
+
+	if items := sink.Items(); len(items) != 46 {
+		t.Errorf("Expected 46 migrated items, got %v", len(items))
+	}
+
+	for _, record := range status.ScanStatusTable() {
+		if record.Status != dp.RangeCompleted && record.Status != dp.RangeSplit {
+			t.Errorf("Expected every range to be completed or split, got %+v", record)
+		}
+		if record.Attempt > 1 {
+			t.Errorf("Expected every range to be read once, got %+v", record)
+		}
+	}
+}
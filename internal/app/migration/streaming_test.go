@@ -0,0 +1,93 @@
+package migration
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	dp "github.com/ImagineLearning/tablestorage-to-dynamo/internal/pkg/dataprovider"
+	"github.com/ImagineLearning/tablestorage-to-dynamo/internal/pkg/dataprovider/dptest"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// countingSource counts the pages with entities read from it
+type countingSource struct {
+	*dptest.MemorySource
+
+	mutex sync.Mutex
+	pages int
+}
+
+func (source *countingSource) ReadPage(queryRange dp.QueryRange, from dp.Continuation) ([]*storage.Entity, dp.Continuation, error) {
+	entities, next, err := source.MemorySource.ReadPage(queryRange, from)
+
+	source.mutex.Lock()
+	defer source.mutex.Unlock()
+
+	if len(entities) > 0 {
+		source.pages++
+	}
+	return entities, next, err
+}
+
+func (source *countingSource) pagesRead() int {
+	source.mutex.Lock()
+	defer source.mutex.Unlock()
+
+	return source.pages
+}
+
+// gatedSink blocks writes until open is closed and counts the batches written
+type gatedSink struct {
+	*dptest.MemorySink
+	open chan bool
+
+	mutex   sync.Mutex
+	batches int
+}
+
+func (sink *gatedSink) WriteBatch(items []map[string]*dynamodb.AttributeValue) ([]map[string]*dynamodb.AttributeValue, error) {
+	<-sink.open
+
+	sink.mutex.Lock()
+	sink.batches++
+	sink.mutex.Unlock()
+
+	return sink.MemorySink.WriteBatch(items)
+}
+
+func TestStartStreamsPagesToWriters(t *testing.T) {
+	source := &countingSource{MemorySource: newHotSource()}
+	sink := &gatedSink{MemorySink: dptest.NewMemorySink(), open: make(chan bool)}
+	status := dptest.NewMemoryStatus()
+	config := newTestConfig()
+	config.NumWorkers = 1
+	config.BufferSize = 1
+	migration := NewMigrationFromProviders(config, source, sink, status)
+
+	errs := make(chan error)
+	go func() { errs <- runWithTimeout(t, migration.Start) }()
+
+	time.Sleep(100 * time.Millisecond)
+	if pages := source.pagesRead(); pages > 4 {
+		t.Errorf("Expected reading to stop while writes are blocked, %v pages were read", pages)
+	}
+
+	close(sink.open)
+	if err := <-errs; err != nil {
+		t.Errorf("Migration failed: %v", err)
+	}
+
+	if items := sink.Items(); len(items) != 46 {
+		t.Errorf("Expected 46 migrated items, got %v", len(items))
+	}
+
+	if sink.batches < 21 {
+		t.Errorf("Expected every page of the hot range to be written on its own, got %v batches", sink.batches)
+	}
+
+	if record, _ := status.Record(dp.NewQueryRange("0f", "80")); record.Status != dp.RangeCompleted || record.ItemsRead != 42 || record.ItemsWritten != 42 {
+		t.Errorf("Expected hot range to be recorded once all of its pages were written, got %+v", record)
+	}
+}
@@ -0,0 +1,52 @@
+package dataprovider
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var (
+	hexLowerAlphabet = strings.Split("0123456789abcdef", "")
+
+	// KeyAlphabets are the named partition key alphabets ParseAlphabet understands
+	KeyAlphabets = map[string]string{
+		"hex-lower":    "0123456789abcdef",
+		"hex-upper":    "0123456789ABCDEF",
+		"decimal":      "0123456789",
+		"alphanumeric": "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz",
+		"base64url":    "-0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ_abcdefghijklmnopqrstuvwxyz",
+	}
+)
+
+// ParseAlphabet returns the characters partition keys are made of, either from the name of one of the
+// KeyAlphabets or from the literal characters in value. Characters are sorted the way table storage orders keys
+// so ranges generated from them are consecutive.
+func ParseAlphabet(value string) ([]string, error) {
+	if preset, ok := KeyAlphabets[value]; ok {
+		value = preset
+	}
+
+	if value == "" {
+		return nil, fmt.Errorf("key alphabet is empty")
+	}
+
+	seen := map[rune]bool{}
+	alphabet := make([]string, 0, len(value))
+	for _, char := range value {
+		switch {
+		case char < 0x20 || char > 0x7e:
+			return nil, fmt.Errorf("key alphabet %q may only contain printable ascii characters", value)
+		case strings.ContainsRune(`/\#?`, char):
+			return nil, fmt.Errorf("key alphabet %q contains %q, which is not allowed in partition keys", value, char)
+		case seen[char]:
+			return nil, fmt.Errorf("key alphabet %q contains %q more than once", value, char)
+		}
+
+		seen[char] = true
+		alphabet = append(alphabet, string(char))
+	}
+
+	sort.Strings(alphabet)
+	return alphabet, nil
+}
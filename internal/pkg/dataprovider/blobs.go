@@ -0,0 +1,161 @@
+package dataprovider
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// BlobStore is where large items are offloaded to
+type BlobStore interface {
+	// PutBlob stores data under name and returns where it can be found
+	PutBlob(name string, data []byte) (string, error)
+}
+
+// blobName builds a blob name from key values, escaped so any key is a valid file and object name. Keys of dots
+// alone are escaped too, . and .. would point at other directories.
+func blobName(keys []string) string {
+	escaped := make([]string, len(keys))
+	for i, key := range keys {
+		escaped[i] = url.PathEscape(key)
+		if strings.Trim(key, ".") == "" {
+			escaped[i] = strings.Replace(key, ".", "%2E", -1)
+		}
+	}
+	return strings.Join(escaped, "/")
+}
+
+// NewBlobStore returns the blob store policy offloads to, an S3 bucket if one is set, its directory otherwise
+func NewBlobStore(policy LargeItemPolicy) BlobStore {
+	if policy.BlobBucket == "" {
+		return DirectoryBlobStore{Dir: policy.BlobDir}
+	}
+
+	awsConfig := &aws.Config{
+		Region:      aws.String(policy.BlobRegion),
+		Credentials: credentials.NewEnvCredentials(),
+	}
+
+	if policy.BlobEndpoint != "" {
+		// S3 compatible stores like minio don't serve buckets as subdomains
+		awsConfig.Endpoint = aws.String(policy.BlobEndpoint)
+		awsConfig.S3ForcePathStyle = aws.Bool(true)
+	}
+
+	return S3BlobStore{Service: s3.New(session.New(awsConfig)), Bucket: policy.BlobBucket}
+}
+
+// DirectoryBlobStore stores blobs as files below Dir
+type DirectoryBlobStore struct {
+	Dir string
+}
+
+// PutBlob writes data to the file name below the directory and returns its path. Names leading out of the
+// directory are refused.
+func (store DirectoryBlobStore) PutBlob(name string, data []byte) (string, error) {
+	path := filepath.Join(store.Dir, filepath.FromSlash(name))
+	if relative, err := filepath.Rel(filepath.Join(store.Dir, "."), path); err != nil || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("blob %v would be written outside of %v", name, store.Dir)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	return path, ioutil.WriteFile(path, data, 0644)
+}
+
+// S3BlobStore stores blobs as objects in an S3 bucket
+type S3BlobStore struct {
+	Service s3iface.S3API
+	Bucket  string
+}
+
+// PutBlob puts data into the object name and returns its s3:// URL
+func (store S3BlobStore) PutBlob(name string, data []byte) (string, error) {
+	_, err := store.Service.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(store.Bucket),
+		Key:         aws.String(name),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	})
+	return fmt.Sprintf("s3://%v/%v", store.Bucket, name), err
+}
+
+// RejectsFile collects items that are not written to dynamo as JSON lines
+type RejectsFile struct {
+	Path string
+
+	mutex sync.Mutex
+	file  *os.File
+}
+
+// NewRejectsFile returns a rejects file at path, rejects.jsonl in the working directory if path is empty. The file
+// is only created once an item is rejected.
+func NewRejectsFile(path string) *RejectsFile {
+	return &RejectsFile{Path: valueOr(path, "rejects.jsonl")}
+}
+
+// rejectedItem is a line of the rejects file, the item is in DynamoDB JSON
+type rejectedItem struct {
+	Size int             `json:"size"`
+	Item json.RawMessage `json:"item"`
+}
+
+// Write appends item of the given size to the file, creating the file on the first write
+func (rejects *RejectsFile) Write(item map[string]*dynamodb.AttributeValue, size int) error {
+	if rejects == nil {
+		return fmt.Errorf("no rejects file to write the item of %v bytes to", size)
+	}
+
+	payload, err := itemJSON(item)
+	if err != nil {
+		return err
+	}
+
+	line, err := json.Marshal(rejectedItem{Size: size, Item: payload})
+	if err != nil {
+		return err
+	}
+
+	rejects.mutex.Lock()
+	defer rejects.mutex.Unlock()
+
+	if rejects.file == nil {
+		rejects.file, err = os.OpenFile(rejects.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("could not open rejects file: %v", err)
+		}
+	}
+
+	_, err = rejects.file.Write(append(line, '\n'))
+	return err
+}
+
+// Close closes the file if anything was written to it
+func (rejects *RejectsFile) Close() error {
+	if rejects == nil {
+		return nil
+	}
+
+	rejects.mutex.Lock()
+	defer rejects.mutex.Unlock()
+
+	if rejects.file == nil {
+		return nil
+	}
+	err := rejects.file.Close()
+	rejects.file = nil
+	return err
+}
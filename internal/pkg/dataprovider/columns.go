@@ -0,0 +1,132 @@
+package dataprovider
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+)
+
+// ColumnSelection decides which properties are migrated besides the ones named in the mapping's ColumnNames.
+// Patterns are globs as understood by path.Match, i.e. Meta* matches every property starting with Meta.
+type ColumnSelection struct {
+	All     bool     // migrate every property
+	Include []string // migrate properties matching these patterns
+	Exclude []string // never migrate properties matching these patterns, even if they are named or included
+}
+
+// Validate checks that every pattern is well formed
+func (selection ColumnSelection) Validate() error {
+	for _, pattern := range append(append([]string{}, selection.Include...), selection.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("column pattern %q is malformed: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// ColumnReport counts how many entities had properties that were neither migrated nor excluded, so columns
+// missing from the configuration don't get lost silently
+type ColumnReport struct {
+	mutex  sync.Mutex
+	counts map[string]int
+}
+
+// NewColumnReport returns an empty report
+func NewColumnReport() *ColumnReport {
+	return &ColumnReport{counts: map[string]int{}}
+}
+
+func (report *ColumnReport) add(names []string) {
+	if report == nil || len(names) == 0 {
+		return
+	}
+
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+
+	for _, name := range names {
+		report.counts[name]++
+	}
+}
+
+// Columns returns the unmigrated property names in order along with how many entities had them
+func (report *ColumnReport) Columns() ([]string, map[string]int) {
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+
+	names := make([]string, 0, len(report.counts))
+	counts := make(map[string]int, len(report.counts))
+	for name, count := range report.counts {
+		names = append(names, name)
+		counts[name] = count
+	}
+	sort.Strings(names)
+	return names, counts
+}
+
+// columns returns the properties of entity that are migrated and adds the ones that are neither migrated nor
+// excluded to the report. Named columns and columns with a null policy of their own are returned even if entity
+// doesn't have them, so their null policy applies.
+func (mapping *Mapping) columns(entity *storage.Entity) []string {
+	if !mapping.Columns.All && len(mapping.Columns.Include) == 0 && len(mapping.Columns.Exclude) == 0 && mapping.Unmapped == nil {
+		named := mapping.ColumnNames[:len(mapping.ColumnNames):len(mapping.ColumnNames)]
+		return append(named, mapping.missingColumns(entity, named)...)
+	}
+
+	named := make(map[string]bool, len(mapping.ColumnNames))
+	for _, name := range mapping.ColumnNames {
+		named[name] = true
+	}
+
+	columns := []string{}
+	unmapped := []string{}
+	for name := range entity.Properties {
+		switch {
+		case matchesAny(mapping.Columns.Exclude, name):
+		case mapping.Columns.All || named[name] || matchesAny(mapping.Columns.Include, name):
+			columns = append(columns, name)
+		default:
+			unmapped = append(unmapped, name)
+		}
+	}
+
+	mapping.Unmapped.add(unmapped)
+	return append(columns, mapping.missingColumns(entity, columns)...)
+}
+
+// missingColumns returns the named columns and the columns with a null policy of their own that neither entity nor
+// columns have, leaving out excluded ones
+func (mapping *Mapping) missingColumns(entity *storage.Entity, columns []string) []string {
+	configured := make([]string, 0, len(mapping.ColumnNames)+len(mapping.Empty.ColumnNulls))
+	configured = append(configured, mapping.ColumnNames...)
+	for name := range mapping.Empty.ColumnNulls {
+		configured = append(configured, name)
+	}
+
+	seen := make(map[string]bool, len(columns))
+	for _, name := range columns {
+		seen[name] = true
+	}
+
+	missing := []string{}
+	for _, name := range configured {
+		if _, found := entity.Properties[name]; found || seen[name] || matchesAny(mapping.Columns.Exclude, name) {
+			continue
+		}
+		seen[name] = true
+		missing = append(missing, name)
+	}
+	return missing
+}
@@ -1,10 +1,30 @@
 package dataprovider
 
 import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/satori/go.uuid"
 )
 
 func TestNewTableStorageProvider(t *testing.T) {
+	requireCloud(t)
 	provider := NewTableStorageProvider(config.TableStorage)
 
 	if provider.Table == nil {
@@ -21,7 +41,7 @@ func TestNewQueryRange(t *testing.T) {
 }
 
 func TestReadFromTableStorage(t *testing.T) {
-
+	requireCloud(t)
 	provider := NewTableStorageProvider(config.TableStorage)
 	results, err := provider.ReadRange(NewQueryRange("00", "0f"))
 
@@ -31,6 +51,7 @@ func TestReadFromTableStorage(t *testing.T) {
 }
 
 func TestNewDynamoProvider(t *testing.T) {
+	requireCloud(t)
 	provider := NewDynamoProvider(config.Dynamo)
 
 	if provider.TableName == "" || provider.Service == nil {
@@ -39,6 +60,7 @@ func TestNewDynamoProvider(t *testing.T) {
 }
 
 func TestMigrationStatusTable(t *testing.T) {
+	requireCloud(t)
 	newConfig := config.Dynamo
 	newConfig.MigrationStatusTableName = "testMigrationStatusTable"
 	provider := NewMigrationStatusProvider(newConfig)
@@ -54,3 +76,1080 @@ func TestMigrationStatusTable(t *testing.T) {
 		t.Errorf("Could not delete migration status table: %v", err)
 	}
 }
+
+// newFakeTableService serves pages of entities the way the table service does, following continuation headers.
+func newFakeTableService(pages ...string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page := 0
+		fmt.Sscan(r.URL.Query().Get("NextPartitionKey"), &page)
+
+		if page+1 < len(pages) {
+			w.Header().Set("x-ms-continuation-NextPartitionKey", fmt.Sprint(page+1))
+			w.Header().Set("x-ms-continuation-NextRowKey", "1")
+		}
+		w.Write([]byte(pages[page]))
+	}))
+}
+
+func TestReadRangeFromCustomEndpoint(t *testing.T) {
+	server := newFakeTableService(
+		`{"value":[{"PartitionKey":"00a","RowKey":"1","Timestamp":"2018-12-01T00:00:00Z","Name":"first"}]}`,
+		`{"value":[{"PartitionKey":"00b","RowKey":"1","Timestamp":"2018-12-01T00:00:00Z","Name":"second"}]}`,
+	)
+	defer server.Close()
+
+	provider := NewTableStorageProvider(TableStorageConfig{
+		ConnectionString: "UseDevelopmentStorage=true",
+		Endpoint:         server.URL,
+		TableName:        "testTable",
+	})
+	results, err := provider.ReadRange(NewQueryRange("00", "0f"))
+
+	if err != nil {
+		t.Fatalf("Could not read from custom endpoint: %v", err)
+	}
+
+	if len(results) != 2 || results[0].Properties["Name"] != "first" || results[1].Properties["Name"] != "second" {
+		t.Errorf("Expected both pages to be read, got %v entities", len(results))
+	}
+}
+
+func TestGenerateRanges(t *testing.T) {
+	ranges, err := GenerateRanges(RangeSpec{Prefixes: []string{"0", "1", "2"}, Precision: 2})
+
+	if err != nil {
+		t.Fatalf("Could not generate ranges: %v", err)
+	}
+
+	if len(ranges) != 32 {
+		t.Fatalf("Expected 32 ranges, got %v", len(ranges))
+	}
+
+	if ranges[0] != NewQueryRange("00", "01") || ranges[31] != NewQueryRange("1f", "2") {
+		t.Errorf("Unexpected first or last range: %v, %v", ranges[0], ranges[31])
+	}
+
+	for i := 1; i < len(ranges); i++ {
+		if ranges[i].Ge != ranges[i-1].Lt {
+			t.Errorf("Gap between ranges %v and %v", ranges[i-1], ranges[i])
+		}
+	}
+}
+
+func TestGenerateRangesFromAlphabet(t *testing.T) {
+	alphabet, err := ParseAlphabet("hex-upper")
+
+	if err != nil {
+		t.Fatalf("Could not parse alphabet: %v", err)
+	}
+
+	ranges, err := GenerateRanges(RangeSpec{Prefixes: []string{"0", "8", "G"}, Precision: 2, Alphabet: alphabet})
+
+	if err != nil {
+		t.Fatalf("Could not generate ranges: %v", err)
+	}
+
+	if len(ranges) != 32 || ranges[15] != NewQueryRange("0F", "80") || ranges[31] != NewQueryRange("8F", "G") {
+		t.Errorf("Unexpected ranges: %v", ranges)
+	}
+
+	for _, key := range []string{"00", "3A9", "7FF", "A01", "FFF"} {
+		covered := 0
+		for _, queryRange := range ranges {
+			if key >= queryRange.Ge && key < queryRange.Lt {
+				covered++
+			}
+		}
+		if covered != 1 {
+			t.Errorf("Expected key %v to be in exactly one range, it is in %v", key, covered)
+		}
+	}
+}
+
+func TestGenerateRangesRejectsOverlappingPrefixes(t *testing.T) {
+	_, err := GenerateRanges(RangeSpec{Prefixes: []string{"1", "1a", "2"}, Precision: 2})
+
+	if err == nil {
+		t.Errorf("Expected prefixes expanded past the next prefix to be rejected")
+	}
+}
+
+func TestParseAlphabet(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+		valid    bool
+	}{
+		{"hex-lower", "0123456789abcdef", true},
+		{"decimal", "0123456789", true},
+		{"base64url", "-0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ_abcdefghijklmnopqrstuvwxyz", true},
+		{"9-0123456785", "", false},
+		{"zyx-", "-xyz", true},
+		{"ab/c", "", false},
+		{"", "", false},
+	}
+
+	for _, test := range tests {
+		alphabet, err := ParseAlphabet(test.value)
+
+		if (err == nil) != test.valid {
+			t.Errorf("Alphabet %q: expected valid %v, got error %v", test.value, test.valid, err)
+		}
+
+		if test.valid && strings.Join(alphabet, "") != test.expected {
+			t.Errorf("Alphabet %q: expected %q, got %q", test.value, test.expected, strings.Join(alphabet, ""))
+		}
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 5, BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+
+	for attempt, max := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 3: 400 * time.Millisecond, 10: time.Second} {
+		delay := policy.Backoff(attempt)
+		if delay < max/2 || delay > max {
+			t.Errorf("Backoff for attempt %v should be between %v and %v, got %v", attempt, max/2, max, delay)
+		}
+	}
+
+	if attempts := (RetryPolicy{}).Attempts(); attempts != 1 {
+		t.Errorf("Expected an empty policy to allow a single attempt, got %v", attempts)
+	}
+}
+
+// fakeBatchWriter answers BatchWriteItem calls with the scripted responses, repeating the last one
+type fakeBatchWriter struct {
+	dynamodbiface.DynamoDBAPI
+	responses []func(input *dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error)
+	calls     int
+}
+
+func (writer *fakeBatchWriter) BatchWriteItem(input *dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error) {
+	response := writer.responses[len(writer.responses)-1]
+	if writer.calls < len(writer.responses) {
+		response = writer.responses[writer.calls]
+	}
+	writer.calls++
+	return response(input)
+}
+
+func leaveUnprocessed(count int) func(input *dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error) {
+	return func(input *dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error) {
+		unprocessed := map[string][]*dynamodb.WriteRequest{}
+		for table, requests := range input.RequestItems {
+			if count > len(requests) {
+				count = len(requests)
+			}
+			unprocessed[table] = requests[:count]
+		}
+		return &dynamodb.BatchWriteItemOutput{UnprocessedItems: unprocessed}, nil
+	}
+}
+
+func failWith(code string) func(input *dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error) {
+	return func(input *dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error) {
+		return nil, awserr.New(code, "fake failure", nil)
+	}
+}
+
+func newTestItems(count int) []map[string]*dynamodb.AttributeValue {
+	items := make([]map[string]*dynamodb.AttributeValue, count)
+	for i := range items {
+		items[i] = map[string]*dynamodb.AttributeValue{
+			"PartitionKey": {S: aws.String(fmt.Sprint(i))},
+			"RowKey":       {S: aws.String("1")},
+		}
+	}
+	return items
+}
+
+func newTestDynamoProvider(writer *fakeBatchWriter) DynamoProvider {
+	return DynamoProvider{
+		Service:   writer,
+		TableName: "testTable",
+		Retry:     RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+	}
+}
+
+func TestBatchWriteRetriesUnprocessedAndThrottledItems(t *testing.T) {
+	writer := &fakeBatchWriter{responses: []func(*dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error){
+		leaveUnprocessed(2),
+		failWith(dynamodb.ErrCodeProvisionedThroughputExceededException),
+		leaveUnprocessed(0),
+	}}
+	provider := newTestDynamoProvider(writer)
+
+	failed, err := provider.WriteBatch(newTestItems(10))
+
+	if err != nil || len(failed) != 0 {
+		t.Errorf("Expected every item to be written, got %v failed items and error %v", len(failed), err)
+	}
+
+	if writer.calls != 3 {
+		t.Errorf("Expected 3 calls to BatchWriteItem, got %v", writer.calls)
+	}
+}
+
+func TestBatchWriteReturnsItemsThatExhaustRetries(t *testing.T) {
+	writer := &fakeBatchWriter{responses: []func(*dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error){
+		leaveUnprocessed(4),
+	}}
+	provider := newTestDynamoProvider(writer)
+
+	failed, err := provider.WriteBatch(newTestItems(10))
+
+	if err != ErrUnprocessedItems || len(failed) != 4 {
+		t.Errorf("Expected 4 unprocessed items, got %v failed items and error %v", len(failed), err)
+	}
+
+	if writer.calls != 3 {
+		t.Errorf("Expected the retry budget of 3 calls to be used, got %v", writer.calls)
+	}
+}
+
+func TestBatchWriteDoesNotRetryValidationErrors(t *testing.T) {
+	writer := &fakeBatchWriter{responses: []func(*dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error){
+		failWith("ValidationException"),
+	}}
+	provider := newTestDynamoProvider(writer)
+
+	failed, err := provider.WriteBatch(newTestItems(10))
+
+	if err == nil || len(failed) != 10 {
+		t.Errorf("Expected all 10 items to be returned with the error, got %v failed items and error %v", len(failed), err)
+	}
+
+	if writer.calls != 1 {
+		t.Errorf("Expected validation errors not to be retried, got %v calls", writer.calls)
+	}
+}
+
+func TestItemSize(t *testing.T) {
+	item := map[string]*dynamodb.AttributeValue{
+		"Name":  {S: aws.String("hello")},
+		"Count": {N: aws.String("-123.45")},
+		"Flag":  {BOOL: aws.Bool(true)},
+		"Tags":  {L: []*dynamodb.AttributeValue{{S: aws.String("a")}, {S: aws.String("bc")}}},
+	}
+
+	// 4+5 for Name, 5+4 for Count, 4+1 for Flag, 4+3+(1+1)+(2+1) for Tags
+	if size := ItemSize(item); size != 35 {
+		t.Errorf("Expected item size 35, got %v", size)
+	}
+}
+
+func TestRangeRecordMarshalsKeysAtTopLevel(t *testing.T) {
+	record := NewRangeRecord(NewQueryRange("00", "01"), RangeCompleted)
+	record.Attempt = 2
+
+	item, err := dynamodbattribute.MarshalMap(record)
+	if err != nil {
+		t.Fatalf("Could not marshal range record: %v", err)
+	}
+
+	if item["Ge"] == nil || *item["Ge"].S != "00" || item["Lt"] == nil || *item["Lt"].S != "01" {
+		t.Errorf("Expected Ge and Lt key attributes, got %v", item)
+	}
+
+	var unmarshaled RangeRecord
+	err = dynamodbattribute.UnmarshalMap(item, &unmarshaled)
+	if err != nil || unmarshaled.QueryRange != record.QueryRange || unmarshaled.Attempt != 2 || !unmarshaled.Completed() {
+		t.Errorf("Range record did not survive a round trip: %+v, %v", unmarshaled, err)
+	}
+}
+
+func TestReadPageResumesFromContinuation(t *testing.T) {
+	filters := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filters = append(filters, r.URL.Query().Get("$filter"))
+		w.Header().Set("x-ms-continuation-NextPartitionKey", "1!8!MDBiMQ--")
+		w.Header().Set("x-ms-continuation-NextRowKey", "1!4!Mg--")
+		w.Write([]byte(`{"value":[{"PartitionKey":"00a","RowKey":"1","Timestamp":"2018-12-01T00:00:00Z"}]}`))
+	}))
+	defer server.Close()
+
+	provider := NewTableStorageProvider(TableStorageConfig{
+		ConnectionString: "UseDevelopmentStorage=true",
+		Endpoint:         server.URL,
+		TableName:        "testTable",
+	})
+	entities, next, err := provider.ReadPage(NewQueryRange("00", "0f"), Continuation{NextPartitionKey: "00a", NextRowKey: "0"})
+
+	if err != nil {
+		t.Fatalf("Could not read page: %v", err)
+	}
+
+	if len(entities) != 1 || next != (Continuation{NextPartitionKey: "00b1", NextRowKey: "2"}) {
+		t.Errorf("Expected one entity and a continuation at 00b1/2, got %v and %+v", len(entities), next)
+	}
+
+	if len(filters) != 1 || filters[0] != "PartitionKey ge '00a' and PartitionKey lt '0f' and (PartitionKey gt '00a' or RowKey ge '0')" {
+		t.Errorf("Expected the query to resume from the continuation, got %v", filters)
+	}
+}
+
+func TestReadPageFailsOnUndecodableContinuation(t *testing.T) {
+	for _, token := range []string{"1!8!@@@@", "00b1"} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("x-ms-continuation-NextPartitionKey", token)
+			w.Header().Set("x-ms-continuation-NextRowKey", "1!4!Mg--")
+			w.Write([]byte(`{"value":[{"PartitionKey":"00a","RowKey":"1","Timestamp":"2018-12-01T00:00:00Z"}]}`))
+		}))
+
+		provider := NewTableStorageProvider(TableStorageConfig{
+			ConnectionString: "UseDevelopmentStorage=true",
+			Endpoint:         server.URL,
+			TableName:        "testTable",
+		})
+		_, next, err := provider.ReadPage(NewQueryRange("00", "0f"), Continuation{})
+		server.Close()
+
+		if err == nil {
+			t.Errorf("Expected continuation token %v to fail the page, got %+v", token, next)
+		}
+	}
+}
+
+func TestReadPageEscapesQuotesInKeys(t *testing.T) {
+	filters := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filters = append(filters, r.URL.Query().Get("$filter"))
+		if len(filters) == 1 {
+			w.Header().Set("x-ms-continuation-NextPartitionKey", "1!12!TydCcmllbg--")
+			w.Header().Set("x-ms-continuation-NextRowKey", "1!8!aXQncw--")
+		}
+		w.Write([]byte(`{"value":[{"PartitionKey":"O'Brien","RowKey":"a","Timestamp":"2018-12-01T00:00:00Z"}]}`))
+	}))
+	defer server.Close()
+
+	provider := NewTableStorageProvider(TableStorageConfig{
+		ConnectionString: "UseDevelopmentStorage=true",
+		Endpoint:         server.URL,
+		TableName:        "testTable",
+	})
+
+	_, next, err := provider.ReadPage(NewQueryRange("O", "P"), Continuation{})
+	if err != nil || next != (Continuation{NextPartitionKey: "O'Brien", NextRowKey: "it's"}) {
+		t.Fatalf("Expected a continuation at O'Brien/it's, got %+v and %v", next, err)
+	}
+
+	if _, next, err = provider.ReadPage(NewQueryRange("O", "P"), next); err != nil || !next.IsZero() {
+		t.Errorf("Expected the last page to be read, got %+v and %v", next, err)
+	}
+
+	expected := "PartitionKey ge 'O''Brien' and PartitionKey lt 'P' and (PartitionKey gt 'O''Brien' or RowKey ge 'it''s')"
+	if len(filters) != 2 || filters[1] != expected {
+		t.Errorf("Expected quotes in keys to be escaped, got %q", filters)
+	}
+}
+
+func TestSplitPolicySplitsAtPartitionBoundaries(t *testing.T) {
+	policy := SplitPolicy{MaxPages: 2, Children: 2}
+	queryRange := NewQueryRange("0", "g")
+
+	if policy.Exceeded(1, 0) || !policy.Exceeded(2, 0) {
+		t.Errorf("Expected ranges to be split after 2 pages")
+	}
+
+	if policy.CanSplit(queryRange, Continuation{NextPartitionKey: "0", NextRowKey: "5"}) {
+		t.Errorf("Expected the first partition of a range not to be split")
+	}
+
+	children := policy.Split(queryRange, Continuation{NextPartitionKey: "8", NextRowKey: "5"})
+	expected := []QueryRange{NewQueryRange("0", "8"), NewQueryRange("8", "c00"), NewQueryRange("c00", "g")}
+	if fmt.Sprint(children) != fmt.Sprint(expected) {
+		t.Errorf("Expected children %v, got %v", expected, children)
+	}
+}
+
+// progressStatus keeps the last checkpoint and record a range progress stores
+type progressStatus struct {
+	StatusStore
+	checkpoint *RangeRecord
+	record     *RangeRecord
+}
+
+func (status *progressStatus) CheckpointRange(record RangeRecord) error {
+	status.checkpoint = &record
+	return nil
+}
+
+func (status *progressStatus) WriteRangeRecord(record RangeRecord) {
+	status.record = &record
+}
+
+func TestRangeProgressCheckpointsPagesInReadOrder(t *testing.T) {
+	status := &progressStatus{}
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	progress := newRangeProgress(RangeRecord{QueryRange: NewQueryRange("0", "g"), Attempt: 1}, status, &FailedRanges{}, wg)
+
+	first := progress.queued(2, Continuation{NextPartitionKey: "3", NextRowKey: "1"})
+	second := progress.queued(2, Continuation{NextPartitionKey: "8", NextRowKey: "1"})
+	third := progress.queued(2, Continuation{NextPartitionKey: "c", NextRowKey: "1"})
+
+	progress.written(second, 2, 0, 0, 10, nil)
+	if status.checkpoint != nil {
+		t.Errorf("Expected no checkpoint before the first page has been written, got %+v", status.checkpoint)
+	}
+
+	progress.written(first, 2, 0, 0, 10, nil)
+	if checkpoint := status.checkpoint; checkpoint == nil || checkpoint.Resume().NextPartitionKey != "8" || checkpoint.ItemsWritten != 4 {
+		t.Errorf("Expected a checkpoint after the second page, got %+v", checkpoint)
+	}
+
+	progress.written(third, 2, 1, 0, 5, ErrUnprocessedItems)
+	progress.doneReading(nil)
+	if record := status.record; record == nil || record.Status != RangePartial || record.Resume().NextPartitionKey != "8" {
+		t.Errorf("Expected a partial record still checkpointed after the second page, got %+v", record)
+	}
+}
+
+func TestRangeProgressRecordsRejectedEntitiesAsPartial(t *testing.T) {
+	status := &progressStatus{}
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	resumed := RangeRecord{QueryRange: NewQueryRange("0", "g"), Attempt: 2, ItemsRejected: 1, Checkpoint: &Continuation{NextPartitionKey: "3", NextRowKey: "1"}}
+	progress := newRangeProgress(resumed, status, &FailedRanges{}, wg)
+
+	page := progress.queued(2, Continuation{})
+	progress.written(page, 2, 0, 0, 10, nil)
+	progress.doneReading(nil)
+
+	if record := status.record; record == nil || record.Status != RangePartial || record.ItemsRejected != 1 || record.Checkpoint != nil {
+		t.Errorf("Expected a partial record of the entity rejected before the checkpoint, read again from the start, got %+v", record)
+	}
+}
+
+// fakeStatusWriter records the conditions status records are written with and fails them like dynamo would
+type fakeStatusWriter struct {
+	dynamodbiface.DynamoDBAPI
+	conditions []string
+}
+
+func (writer *fakeStatusWriter) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	writer.conditions = append(writer.conditions, aws.StringValue(input.ConditionExpression))
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (writer *fakeStatusWriter) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	writer.conditions = append(writer.conditions, aws.StringValue(input.ConditionExpression))
+	return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "condition failed", nil)
+}
+
+func TestDynamoStatusWritesAreConditionedOnTheLease(t *testing.T) {
+	writer := &fakeStatusWriter{}
+	provider := DynamoProvider{Service: writer, TableName: "statusTable"}
+	queryRange := NewQueryRange("0", "g")
+
+	provider.WriteRangeRecord(RangeRecord{QueryRange: queryRange, Status: RangeCompleted})
+	provider.WriteRangeRecord(RangeRecord{QueryRange: queryRange, Status: RangeCompleted, LeaseOwner: "job@pod"})
+	if len(writer.conditions) != 2 || writer.conditions[0] != "" || writer.conditions[1] != leaseHeldCondition {
+		t.Errorf("Expected only the record with a lease owner to be conditioned, got %q", writer.conditions)
+	}
+
+	if err := provider.CheckpointRange(RangeRecord{QueryRange: queryRange, LeaseOwner: "job@pod"}); err != ErrLeaseLost || writer.conditions[2] != leaseHeldCondition {
+		t.Errorf("Expected a conditioned checkpoint to report the lost lease, got %v", err)
+	}
+}
+
+func TestKeySchemaBuildsKeysFromTemplates(t *testing.T) {
+	entity := &storage.Entity{PartitionKey: "00a", RowKey: "1"}
+
+	renamed := KeySchema{HashKey: "pk", RangeKey: "sk"}
+	if key := renamed.Key(entity); len(key) != 2 || *key["pk"].S != "00a" || *key["sk"].S != "1" {
+		t.Errorf("Expected keys to be renamed to pk and sk, got %v", key)
+	}
+
+	composite := KeySchema{HashKey: "id", HashTemplate: "{PartitionKey}#{RowKey}", Prefix: "user#", HashOnly: true, KeepKeys: true}
+	item := composite.Item(entity)
+	if len(item) != 3 || *item["id"].S != "user#00a#1" || *item["PartitionKey"].S != "00a" || *item["RowKey"].S != "1" {
+		t.Errorf("Expected a prefixed composite hash key along with the kept keys, got %v", item)
+	}
+
+	if names := composite.KeyNames(); fmt.Sprint(names) != "[id]" {
+		t.Errorf("Expected a hash only schema to name one key, got %v", names)
+	}
+
+	if err := (KeySchema{HashTemplate: "{PartitionKey}#{Name}"}).Validate(); err == nil {
+		t.Errorf("Expected templates referring to unknown placeholders to be rejected")
+	}
+
+	if err := (KeySchema{HashOnly: true}).Validate(); err == nil {
+		t.Errorf("Expected a hash only schema keyed on the partition key alone to be rejected")
+	}
+
+	if err := (KeySchema{HashTemplate: "{RowKey}", RangeTemplate: "{PartitionKey}"}).Validate(); err != nil {
+		t.Errorf("Expected keys referring to both placeholders to be accepted, got %v", err)
+	}
+
+	if err := (KeySchema{HashKey: "id", RangeKey: "id"}).Validate(); err == nil {
+		t.Errorf("Expected hash and range keys of the same name to be rejected")
+	}
+}
+
+// fakeTableDescriber describes a table keyed on keySchema
+type fakeTableDescriber struct {
+	dynamodbiface.DynamoDBAPI
+	keySchema []*dynamodb.KeySchemaElement
+}
+
+func (describer *fakeTableDescriber) DescribeTable(input *dynamodb.DescribeTableInput) (*dynamodb.DescribeTableOutput, error) {
+	return &dynamodb.DescribeTableOutput{Table: &dynamodb.TableDescription{KeySchema: describer.keySchema}}, nil
+}
+
+func TestVerifyKeysComparesTableKeySchema(t *testing.T) {
+	provider := DynamoProvider{
+		Service: &fakeTableDescriber{keySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String("sk"), KeyType: aws.String(dynamodb.KeyTypeRange)},
+			{AttributeName: aws.String("pk"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+		}},
+		TableName: "testTable",
+	}
+
+	if err := provider.VerifyKeys([]string{"pk", "sk"}); err != nil {
+		t.Errorf("Expected keys pk and sk to match, got %v", err)
+	}
+
+	if err := provider.VerifyKeys([]string{"PartitionKey", "RowKey"}); err == nil {
+		t.Errorf("Expected default keys not to match a table keyed on pk and sk")
+	}
+
+	if err := provider.VerifyKeys([]string{"pk"}); err == nil {
+		t.Errorf("Expected a hash only schema not to match a table with a range key")
+	}
+}
+
+func TestMappingSelectsColumns(t *testing.T) {
+	entity := &storage.Entity{
+		PartitionKey: "00a",
+		RowKey:       "1",
+		Properties:   map[string]interface{}{"Name": "a", "MetaOwner": "b", "MetaSecret": "c", "Extra": "d"},
+	}
+
+	report := NewColumnReport()
+	named := &Mapping{ColumnNames: []string{"Name"}, Columns: ColumnSelection{Include: []string{"Meta*"}, Exclude: []string{"*Secret"}}, Unmapped: report}
+	item, _ := storageEntityToDynamoMap(entity, named)
+
+	if item["Name"] == nil || item["MetaOwner"] == nil || item["MetaSecret"] != nil || item["Extra"] != nil {
+		t.Errorf("Expected named and included columns without excluded ones, got %v", item)
+	}
+
+	if names, counts := report.Columns(); fmt.Sprint(names) != "[Extra]" || counts["Extra"] != 1 {
+		t.Errorf("Expected only the unconfigured column to be reported, got %v %v", names, counts)
+	}
+
+	all := &Mapping{Columns: ColumnSelection{All: true, Exclude: []string{"Meta*"}}}
+	item, _ = storageEntityToDynamoMap(entity, all)
+
+	if len(item) != 5 || item["Name"] == nil || item["Extra"] == nil {
+		t.Errorf("Expected every column but the excluded ones along with keys and timestamp, got %v", item)
+	}
+
+	if err := (ColumnSelection{Include: []string{"[Meta"}}).Validate(); err == nil {
+		t.Errorf("Expected a malformed pattern to be rejected")
+	}
+}
+
+func TestColumnAttributeCoversEdmTypes(t *testing.T) {
+	id := uuid.NewV4()
+	str := func(value string) *dynamodb.AttributeValue { return &dynamodb.AttributeValue{S: aws.String(value)} }
+	num := func(value string) *dynamodb.AttributeValue { return &dynamodb.AttributeValue{N: aws.String(value)} }
+
+	cases := []struct {
+		value         interface{}
+		attributeType AttributeType
+		expected      *dynamodb.AttributeValue
+	}{
+		{"text", "", str("text")},
+		{"", "", str("")},
+		{nil, "", nil},
+		{int32(-7), "", num("-7")},
+		{int64(1) << 40, "", num("1099511627776")},
+		{float64(5), "", num("5")},
+		{0.25, "", num("0.25")},
+		{true, "", &dynamodb.AttributeValue{BOOL: aws.Bool(true)}},
+		{time.Date(2018, 12, 1, 0, 0, 0, 0, time.UTC), "", str("2018-12-01T00:00:00Z")},
+		{id, "", str(id.String())},
+		{[]byte("raw"), "", &dynamodb.AttributeValue{B: []byte("raw")}},
+		{id, TypeBinary, &dynamodb.AttributeValue{B: id.Bytes()}},
+		{" 42 ", TypeNumber, num("42")},
+		{int64(42), TypeString, str("42")},
+		{true, TypeNumber, num("1")},
+		{"false", TypeBool, &dynamodb.AttributeValue{BOOL: aws.Bool(false)}},
+		{[]byte("raw"), TypeString, str("cmF3")},
+	}
+
+	for _, c := range cases {
+		attribute, err := columnAttribute(c.value, c.attributeType)
+		if err != nil {
+			t.Errorf("Could not convert %#v to %v: %v", c.value, c.attributeType, err)
+		} else if fmt.Sprint(attribute) != fmt.Sprint(c.expected) {
+			t.Errorf("Expected %#v as %q to convert to %v, got %v", c.value, c.attributeType, c.expected, attribute)
+		}
+	}
+
+	for _, value := range []interface{}{struct{}{}, math.NaN(), "yes"} {
+		if _, err := columnAttribute(value, TypeNumber); err == nil {
+			t.Errorf("Expected %#v not to convert to a number", value)
+		}
+	}
+
+	if _, err := ParseColumnTypes(map[string]string{"Id": "bs"}); err == nil {
+		t.Errorf("Expected an unsupported type override to be rejected")
+	}
+}
+
+func TestStrictMappingFailsEntitiesWithUnsupportedValues(t *testing.T) {
+	entity := &storage.Entity{PartitionKey: "00a", RowKey: "1", Properties: map[string]interface{}{"Name": "a", "Odd": struct{}{}}}
+
+	skipped := NewColumnReport()
+	lenient := &Mapping{ColumnNames: []string{"Name", "Odd"}, Skipped: skipped}
+	item, err := storageEntityToDynamoMap(entity, lenient)
+
+	if err != nil || item["Name"] == nil || item["Odd"] != nil {
+		t.Errorf("Expected the unsupported value to be skipped, got %v and %v", item, err)
+	}
+
+	if names, _ := skipped.Columns(); fmt.Sprint(names) != "[Odd]" {
+		t.Errorf("Expected the skipped column to be reported, got %v", names)
+	}
+
+	strict := &Mapping{ColumnNames: []string{"Name", "Odd"}, Strict: true}
+	if _, err := storageEntityToDynamoMap(entity, strict); err == nil || !strings.Contains(err.Error(), "Odd") {
+		t.Errorf("Expected a strict mapping to fail on the unsupported value, got %v", err)
+	}
+}
+
+func TestMappingAppliesEmptyValuePolicies(t *testing.T) {
+	entity := &storage.Entity{PartitionKey: "00a", RowKey: "1", Properties: map[string]interface{}{
+		"Name": "", "Notes": "", "Code": "", "Count": "",
+	}}
+
+	empty, err := ParseEmptyValues("null", "", map[string]string{"Notes": "empty", "Code": "Sentinel=-", "Count": "sentinel=0"}, map[string]string{"Owner": "sentinel=nobody"})
+	if err != nil {
+		t.Fatalf("Could not parse policies: %v", err)
+	}
+
+	mapping := &Mapping{
+		ColumnNames: []string{"Name", "Notes", "Code", "Count", "Parent", "Owner"},
+		Types:       map[string]AttributeType{"Count": TypeNumber},
+		Empty:       empty,
+	}
+	item, err := storageEntityToDynamoMap(entity, mapping)
+	if err != nil {
+		t.Fatalf("Could not map entity: %v", err)
+	}
+
+	expected := map[string]*dynamodb.AttributeValue{
+		"Name":  {NULL: aws.Bool(true)},
+		"Notes": {S: aws.String("")},
+		"Code":  {S: aws.String("-")},
+		"Count": {N: aws.String("0")},
+		"Owner": {S: aws.String("nobody")},
+	}
+	for name, attribute := range expected {
+		if fmt.Sprint(item[name]) != fmt.Sprint(attribute) {
+			t.Errorf("Expected %v to be %v, got %v", name, attribute, item[name])
+		}
+	}
+
+	if _, found := item["Parent"]; found {
+		t.Errorf("Expected the missing Parent to be omitted, got %v", item["Parent"])
+	}
+
+	mapping = &Mapping{Columns: ColumnSelection{All: true}, Empty: empty}
+	if item, err = storageEntityToDynamoMap(entity, mapping); err != nil || fmt.Sprint(item["Owner"]) != fmt.Sprint(expected["Owner"]) {
+		t.Errorf("Expected the missing Owner to get its null policy when every column is migrated, got %v and %v", item["Owner"], err)
+	}
+
+	if _, err := ParseEmptyValues("zero", "", nil, nil); err == nil {
+		t.Errorf("Expected an unknown policy to be rejected")
+	}
+}
+
+func TestPipelineTransformsItems(t *testing.T) {
+	pipeline, err := ParsePipeline(`[
+		{"op": "rename", "column": "Name", "to": "FullName"},
+		{"op": "split", "column": "FullName", "columns": ["First", "Last"], "separator": " "},
+		{"op": "upper", "column": "Last"},
+		{"op": "concat", "column": "Initials", "columns": ["Last", "First"], "separator": ", "},
+		{"op": "cast", "column": "Count", "type": "s"},
+		{"op": "default", "column": "Score", "value": "0", "type": "N"},
+		{"op": "template", "column": "Path", "value": "/{PartitionKey}/{RowKey}/{Missing}{Count}"},
+		{"op": "lower", "column": "Path"},
+		{"op": "drop", "columns": ["Secret", "FullName"]}
+	]`)
+	if err != nil {
+		t.Fatalf("Could not parse pipeline: %v", err)
+	}
+
+	mapping := &Mapping{ColumnNames: []string{"Name", "Count", "Secret"}, Transforms: pipeline}
+	if err := pipeline.Validate(mapping.Keys.KeyNames()); err != nil {
+		t.Fatalf("Expected the pipeline to be valid: %v", err)
+	}
+
+	entity := &storage.Entity{PartitionKey: "00A", RowKey: "1", Properties: map[string]interface{}{
+		"Name": "Ada King Lovelace", "Count": int64(3), "Secret": "x",
+	}}
+	item, err := storageEntityToDynamoMap(entity, mapping)
+	if err != nil {
+		t.Fatalf("Could not map entity: %v", err)
+	}
+
+	expected := map[string]*dynamodb.AttributeValue{
+		"PartitionKey": {S: aws.String("00A")},
+		"RowKey":       {S: aws.String("1")},
+		"First":        {S: aws.String("Ada")},
+		"Last":         {S: aws.String("KING LOVELACE")},
+		"Initials":     {S: aws.String("KING LOVELACE, Ada")},
+		"Count":        {S: aws.String("3")},
+		"Score":        {N: aws.String("0")},
+		"Path":         {S: aws.String("/00a/1/3")},
+	}
+	for name, attribute := range expected {
+		if fmt.Sprint(item[name]) != fmt.Sprint(attribute) {
+			t.Errorf("Expected %v to be %v, got %v", name, attribute, item[name])
+		}
+	}
+	if len(item) != len(expected)+1 {
+		t.Errorf("Expected only the transformed attributes and Timestamp, got %v", item)
+	}
+
+	cast := Pipeline{{Op: OpCast, Column: "First", Type: "N"}}
+	if _, err := storageEntityToDynamoMap(entity, &Mapping{ColumnNames: []string{"Name"}, Transforms: append(pipeline[:2:2], cast...)}); err == nil {
+		t.Errorf("Expected casting a name to a number to fail the entity")
+	}
+
+	invalid := []Pipeline{
+		{{Op: "reverse", Column: "Name"}},
+		{{Op: OpRename, Column: "Name"}},
+		{{Op: OpCast, Column: "Name", Type: "BS"}},
+		{{Op: OpSplit, Column: "Name", Columns: []string{"First"}}},
+		{{Op: OpTemplate, Column: "RowKey", Value: "{Name}"}},
+	}
+	for _, pipeline := range invalid {
+		if err := pipeline.Validate(mapping.Keys.KeyNames()); err == nil {
+			t.Errorf("Expected %+v to be rejected", pipeline)
+		}
+	}
+}
+
+func TestMappingDecodesJSONColumns(t *testing.T) {
+	entity := &storage.Entity{PartitionKey: "00a", RowKey: "1", Properties: map[string]interface{}{
+		"Meta":   `{"name": "a", "size": 12.50, "tags": ["x", 1, null], "ok": true}`,
+		"Tags":   `["red", "blue", "red"]`,
+		"Scores": `[3, 1.5]`,
+		"Any":    `"text"`,
+		"Broken": `{"name": `,
+	}}
+	types, err := ParseColumnTypes(map[string]string{"Meta": "m", "Tags": "SS", "Scores": "ns", "Any": "json", "Broken": "M"})
+	if err != nil {
+		t.Fatalf("Could not parse types: %v", err)
+	}
+
+	mapping := &Mapping{ColumnNames: []string{"Meta", "Tags", "Scores", "Any", "Broken"}, Types: types}
+	item, err := storageEntityToDynamoMap(entity, mapping)
+	if err != nil {
+		t.Fatalf("Could not map entity: %v", err)
+	}
+
+	str := func(value string) *dynamodb.AttributeValue { return &dynamodb.AttributeValue{S: aws.String(value)} }
+	expected := map[string]*dynamodb.AttributeValue{
+		"Meta": {M: map[string]*dynamodb.AttributeValue{
+			"name": str("a"),
+			"size": {N: aws.String("12.50")},
+			"tags": {L: []*dynamodb.AttributeValue{str("x"), {N: aws.String("1")}, {NULL: aws.Bool(true)}}},
+			"ok":   {BOOL: aws.Bool(true)},
+		}},
+		"Tags":   {SS: []*string{aws.String("red"), aws.String("blue")}},
+		"Scores": {NS: []*string{aws.String("3"), aws.String("1.5")}},
+		"Any":    str("text"),
+		"Broken": str(`{"name": `),
+	}
+	for name, attribute := range expected {
+		if !reflect.DeepEqual(item[name], attribute) {
+			t.Errorf("Expected %v to be %v, got %v", name, attribute, item[name])
+		}
+	}
+
+	mapping.InvalidJSON = JSONNull
+	if item, _ := storageEntityToDynamoMap(entity, mapping); item["Broken"] == nil || item["Broken"].NULL == nil {
+		t.Errorf("Expected invalid JSON to be stored as NULL, got %v", item["Broken"])
+	}
+
+	mapping.InvalidJSON = JSONSkip
+	mapping.Skipped = NewColumnReport()
+	if item, err := storageEntityToDynamoMap(entity, mapping); err != nil || item["Broken"] != nil {
+		t.Errorf("Expected invalid JSON to be skipped, got %v and %v", item["Broken"], err)
+	}
+	if names, _ := mapping.Skipped.Columns(); fmt.Sprint(names) != "[Broken]" {
+		t.Errorf("Expected the skipped JSON column to be reported, got %v", names)
+	}
+
+	mapping.InvalidJSON = JSONFail
+	if _, err := storageEntityToDynamoMap(entity, mapping); err == nil || !strings.Contains(err.Error(), "Broken") {
+		t.Errorf("Expected invalid JSON to fail the entity, got %v", err)
+	}
+
+	for _, invalid := range []struct {
+		text          string
+		attributeType AttributeType
+	}{
+		{`[1, 2]`, TypeMap},
+		{`{}`, TypeList},
+		{`[]`, TypeStringSet},
+		{`["a", 1]`, TypeStringSet},
+		{`[1, [2]]`, TypeNumberSet},
+		{`{} {}`, TypeJSON},
+	} {
+		if attribute, err := jsonAttribute(invalid.text, invalid.attributeType); err == nil {
+			t.Errorf("Expected %v as %v to be rejected, got %v", invalid.text, invalid.attributeType, attribute)
+		}
+	}
+}
+
+type memoryBlobStore struct {
+	blobs map[string][]byte
+}
+
+func (store *memoryBlobStore) PutBlob(name string, data []byte) (string, error) {
+	store.blobs[name] = data
+	return "memory://" + name, nil
+}
+
+func TestLargeItemsAreHandledByStrategy(t *testing.T) {
+	keyNames := []string{"PartitionKey", "RowKey"}
+	newItem := func() map[string]*dynamodb.AttributeValue {
+		return map[string]*dynamodb.AttributeValue{
+			"PartitionKey": {S: aws.String("00a")},
+			"RowKey":       {S: aws.String("1")},
+			"Body":         {S: aws.String(strings.Repeat("a", 2000))},
+			"Count":        {N: aws.String("3")},
+		}
+	}
+	policy := LargeItemPolicy{MaxSize: 1000, ChunkSize: 600}
+
+	small := map[string]*dynamodb.AttributeValue{"PartitionKey": {S: aws.String("00a")}, "RowKey": {S: aws.String("2")}}
+	if items, err := (*LargeItems)(nil).items(small); err != nil || len(items) != 1 {
+		t.Errorf("Expected items that fit to be written as they are, got %v and %v", items, err)
+	}
+	if _, err := (*LargeItems)(nil).items(map[string]*dynamodb.AttributeValue{"Body": {B: make([]byte, maxItemSize)}}); err == nil {
+		t.Errorf("Expected items bigger than dynamo accepts to fail without a handler")
+	}
+
+	policy.Strategy = "compress"
+	items, err := NewLargeItems(policy, keyNames, nil, nil).items(newItem())
+	if err != nil || len(items) != 1 || items[0]["Body"].B == nil || items[0]["Count"].N == nil || *items[0]["RowKey"].S != "1" {
+		t.Errorf("Expected Body to be compressed, got %v and %v", items, err)
+	} else if fmt.Sprint(aws.StringValueSlice(items[0]["Compressed"].SS)) != "[Body]" {
+		t.Errorf("Expected the compressed attributes to be listed, got %v", items[0]["Compressed"])
+	}
+
+	policy.Strategy = "chunk"
+	items, err = NewLargeItems(policy, keyNames, nil, nil).items(newItem())
+	if err != nil || len(items) != 5 {
+		t.Fatalf("Expected 4 chunks and a manifest, got %v items and %v", len(items), err)
+	}
+	payload := []byte{}
+	for n, chunk := range items[:4] {
+		if *chunk["RowKey"].S != fmt.Sprintf("1#chunk-%v", n+1) {
+			t.Errorf("Expected chunk %v to be keyed on its number, got %v", n+1, chunk["RowKey"])
+		}
+		payload = append(payload, chunk["Data"].B...)
+	}
+	if manifest := items[4]; *manifest["RowKey"].S != "1" || *manifest["Chunks"].N != "4" || manifest["Body"] != nil {
+		t.Errorf("Expected a manifest under the item's key, got %v", manifest)
+	}
+	if !strings.Contains(string(payload), `"Count":{"N":"3"}`) || strings.Contains(string(payload), "RowKey") {
+		t.Errorf("Expected the chunks to hold the attributes but the keys, got %s", payload)
+	}
+
+	policy.Strategy = "offload"
+	blobs := &memoryBlobStore{blobs: map[string][]byte{}}
+	policy.BlobPrefix = "items/"
+	items, err = NewLargeItems(policy, keyNames, blobs, nil).items(newItem())
+	if err != nil || len(items) != 1 || *items[0]["Offloaded"].S != "memory://items/00a/1.json" || items[0]["Body"] != nil {
+		t.Errorf("Expected a pointer to the offloaded item, got %v and %v", items, err)
+	}
+	if !strings.Contains(string(blobs.blobs["items/00a/1.json"]), strings.Repeat("a", 2000)) {
+		t.Errorf("Expected the whole item to be offloaded, got %v", blobs.blobs)
+	}
+
+	dir, err := ioutil.TempDir("", "rejects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	policy.Strategy = "reject"
+	rejects := NewRejectsFile(filepath.Join(dir, "rejects.jsonl"))
+	large := NewLargeItems(policy, keyNames, nil, rejects)
+	items, err = large.items(newItem())
+	rejects.Close()
+	if err != nil || len(items) != 0 {
+		t.Errorf("Expected the item to be rejected, got %v and %v", items, err)
+	}
+	if contents, _ := ioutil.ReadFile(rejects.Path); !strings.HasPrefix(string(contents), `{"size":2033,"item":{`) {
+		t.Errorf("Expected the rejected item in the rejects file, got %s", contents)
+	}
+	if handled := large.Handled(); handled[LargeReject] != 1 {
+		t.Errorf("Expected the rejected item to be counted, got %v", handled)
+	}
+
+	for _, invalid := range []LargeItemPolicy{{Strategy: "shrink"}, {Strategy: "offload"}, {ChunkSize: maxItemSize}} {
+		if err := invalid.Validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", invalid)
+		}
+	}
+}
+
+func TestItemJSONWritesDynamoJSON(t *testing.T) {
+	item := map[string]*dynamodb.AttributeValue{
+		"Name":  {S: aws.String("a")},
+		"Count": {N: aws.String("3")},
+		"Meta":  {M: map[string]*dynamodb.AttributeValue{"Tags": {SS: aws.StringSlice([]string{"x"})}, "Empty": {L: []*dynamodb.AttributeValue{}}}},
+		"Gone":  {NULL: aws.Bool(true)},
+		"Raw":   {B: []byte("hi")},
+	}
+
+	payload, err := itemJSON(item)
+	expected := `{"Count":{"N":"3"},"Gone":{"NULL":true},"Meta":{"M":{"Empty":{"L":[]},"Tags":{"SS":["x"]}}},"Name":{"S":"a"},"Raw":{"B":"aGk="}}`
+	if err != nil || string(payload) != expected {
+		t.Errorf("Expected %s, got %s and %v", expected, payload, err)
+	}
+}
+
+func TestDirectoryBlobStoreStaysInItsDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := DirectoryBlobStore{Dir: filepath.Join(dir, "blobs")}
+
+	path, err := store.PutBlob(blobName([]string{"..", "x"})+".json", []byte("{}"))
+	if err != nil || filepath.Dir(filepath.Dir(path)) != store.Dir {
+		t.Errorf("Expected a key of dots to be escaped below the directory, got %v and %v", path, err)
+	}
+
+	if _, err := store.PutBlob("../x.json", []byte("{}")); err == nil {
+		t.Errorf("Expected a blob outside of the directory to be refused")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "x.json")); err == nil {
+		t.Errorf("Expected nothing to be written outside of the directory")
+	}
+}
+
+func TestMappingWritesTimesInColumnFormats(t *testing.T) {
+	due := time.Date(2019, 3, 4, 5, 6, 7, 891234567, time.FixedZone("PST", -8*3600))
+	entity := &storage.Entity{PartitionKey: "00a", RowKey: "1", TimeStamp: time.Date(2018, 12, 1, 0, 0, 0, 500000000, time.UTC), Properties: map[string]interface{}{
+		"Due": due, "Created": due, "Day": due, "Seen": due, "Closed": due,
+	}}
+
+	formats, err := ParseTimeFormats("epochmillis", map[string]string{"Timestamp": "epoch", "Due": "RFC3339Nano", "Day": "2006-01-02", "Seen": "default", "Closed": "epoch"})
+	if err != nil {
+		t.Fatalf("Could not parse time formats: %v", err)
+	}
+
+	mapping := &Mapping{
+		ColumnNames: []string{"Due", "Created", "Day", "Seen", "Closed"},
+		Types:       map[string]AttributeType{"Closed": TypeString},
+		TimeFormats: formats,
+		Timestamp:   "ModifiedAt",
+	}
+	item, err := storageEntityToDynamoMap(entity, mapping)
+	if err != nil {
+		t.Fatalf("Could not map entity: %v", err)
+	}
+
+	expected := map[string]*dynamodb.AttributeValue{
+		"ModifiedAt": {N: aws.String("1543622400")},
+		"Due":        {S: aws.String("2019-03-04T13:06:07.891234567Z")},
+		"Created":    {N: aws.String("1551704767891")},
+		"Day":        {S: aws.String("2019-03-04")},
+		"Seen":       {S: aws.String("2019-03-04T13:06:07.891234Z")},
+		"Closed":     {S: aws.String("1551704767")},
+	}
+	for name, attribute := range expected {
+		if fmt.Sprint(item[name]) != fmt.Sprint(attribute) {
+			t.Errorf("Expected %v to be %v, got %v", name, attribute, item[name])
+		}
+	}
+	if item["Timestamp"] != nil {
+		t.Errorf("Expected Timestamp to be renamed, got %v", item["Timestamp"])
+	}
+
+	mapping.NoTimestamp = true
+	if item, _ := storageEntityToDynamoMap(entity, mapping); item["ModifiedAt"] != nil || len(item) != 7 {
+		t.Errorf("Expected Timestamp to be dropped, got %v", item)
+	}
+
+	if _, err := ParseTimeFormats("", map[string]string{"Due": "epoc"}); err == nil {
+		t.Errorf("Expected a format that is neither a preset nor a layout to be rejected")
+	}
+}
+
+func TestTTLDerivesExpiries(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	newEntity := func(properties map[string]interface{}) *storage.Entity {
+		return &storage.Entity{PartitionKey: "00a", RowKey: "1", TimeStamp: time.Date(2019, 12, 1, 0, 0, 0, 0, time.UTC), Properties: properties}
+	}
+
+	ttl := NewTTL(TTLPolicy{Attribute: "ExpiresAt", Retention: 24 * time.Hour})
+	mapping := &Mapping{TTL: ttl}
+	item, err := storageEntityToDynamoMap(newEntity(nil), mapping)
+	if err != nil || item["ExpiresAt"] == nil || *item["ExpiresAt"].N != "1575244800" {
+		t.Errorf("Expected an expiry a day after Timestamp, got %v and %v", item, err)
+	}
+
+	ttl = NewTTL(TTLPolicy{Attribute: "ExpiresAt", From: "Closed", Retention: 48 * time.Hour, SkipExpired: true})
+	ttl.now = func() time.Time { return now }
+	mapping = &Mapping{TTL: ttl, Skipped: NewColumnReport()}
+
+	cases := []struct {
+		closed   interface{}
+		expected string
+	}{
+		{time.Date(2019, 12, 31, 0, 0, 0, 0, time.UTC), "1577923200"},
+		{"2019-12-31T00:00:00Z", "1577923200"},
+		{float64(1577750400), "1577923200"},
+		{nil, ""},
+	}
+	for _, c := range cases {
+		item, err := storageEntityToDynamoMap(newEntity(map[string]interface{}{"Closed": c.closed}), mapping)
+		if err != nil || item == nil {
+			t.Errorf("Expected %v to be written, got %v", c.closed, err)
+			continue
+		}
+
+		expires := ""
+		if item["ExpiresAt"] != nil {
+			expires = aws.StringValue(item["ExpiresAt"].N)
+		}
+		if expires != c.expected {
+			t.Errorf("Expected %v to expire at %q, got %q", c.closed, c.expected, expires)
+		}
+	}
+
+	if item, err := storageEntityToDynamoMap(newEntity(map[string]interface{}{"Closed": "2019-12-29T00:00:00Z"}), mapping); item != nil || err != nil {
+		t.Errorf("Expected the expired entity to be skipped, got %v and %v", item, err)
+	}
+	if ttl.Expired() != 1 {
+		t.Errorf("Expected the expired entity to be counted, got %v", ttl.Expired())
+	}
+
+	if item, err := storageEntityToDynamoMap(newEntity(map[string]interface{}{"Closed": "yesterday"}), mapping); err != nil || item == nil || item["ExpiresAt"] != nil {
+		t.Errorf("Expected an entity without a readable time to be written without expiry, got %v and %v", item, err)
+	}
+	if names, _ := mapping.Skipped.Columns(); fmt.Sprint(names) != "[Closed]" {
+		t.Errorf("Expected the unreadable column to be reported, got %v", names)
+	}
+
+	for _, invalid := range []TTLPolicy{{SkipExpired: true}, {Attribute: "RowKey"}, {Attribute: "ExpiresAt", Retention: -time.Hour}} {
+		if err := invalid.Validate([]string{"PartitionKey", "RowKey"}); err == nil {
+			t.Errorf("Expected %+v to be rejected", invalid)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+// Package dptest provides in-memory sources, sinks and status stores to test migrations without table storage or
+// dynamo
+package dptest
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	dp "github.com/ImagineLearning/tablestorage-to-dynamo/internal/pkg/dataprovider"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// MemorySource is an in-memory Source. Pages hold PageSize entities, 1000 like table
+// storage if it is not set.
+type MemorySource struct {
+	PageSize int
+
+	mutex    sync.Mutex
+	entities []*storage.Entity
+}
+
+// NewMemorySource returns a source that serves the given entities
+func NewMemorySource(entities ...*storage.Entity) *MemorySource {
+	source := &MemorySource{}
+	source.Add(entities...)
+	return source
+}
+
+// Add adds entities to the source, keeping them ordered by partition key and row key like table storage does
+func (source *MemorySource) Add(entities ...*storage.Entity) {
+	source.mutex.Lock()
+	defer source.mutex.Unlock()
+
+	source.entities = append(source.entities, entities...)
+	sort.SliceStable(source.entities, func(i, j int) bool {
+		if source.entities[i].PartitionKey != source.entities[j].PartitionKey {
+			return source.entities[i].PartitionKey < source.entities[j].PartitionKey
+		}
+		return source.entities[i].RowKey < source.entities[j].RowKey
+	})
+}
+
+// Ranges enumerates the query ranges to migrate by expanding the prefixes in spec
+func (source *MemorySource) Ranges(spec dp.RangeSpec) ([]dp.QueryRange, error) {
+	return dp.GenerateRanges(spec)
+}
+
+// ReadRange returns every entity with a partition key inside queryRange
+func (source *MemorySource) ReadRange(queryRange dp.QueryRange) ([]*storage.Entity, error) {
+	source.mutex.Lock()
+	defer source.mutex.Unlock()
+
+	results := []*storage.Entity{}
+	for _, entity := range source.entities {
+		if entity.PartitionKey >= queryRange.Ge && entity.PartitionKey < queryRange.Lt {
+			results = append(results, entity)
+		}
+	}
+	return results, nil
+}
+
+// ReadPage returns up to PageSize entities inside queryRange, starting at from
+func (source *MemorySource) ReadPage(queryRange dp.QueryRange, from dp.Continuation) ([]*storage.Entity, dp.Continuation, error) {
+	source.mutex.Lock()
+	defer source.mutex.Unlock()
+
+	pageSize := source.PageSize
+	if pageSize < 1 {
+		pageSize = 1000
+	}
+
+	start := dp.Continuation{NextPartitionKey: queryRange.Ge}
+	if !from.IsZero() {
+		start = from
+	}
+
+	page := []*storage.Entity{}
+	for _, entity := range source.entities {
+		if entity.PartitionKey < start.NextPartitionKey || entity.PartitionKey >= queryRange.Lt ||
+			(entity.PartitionKey == start.NextPartitionKey && entity.RowKey < start.NextRowKey) {
+			continue
+		}
+
+		if len(page) == pageSize {
+			return page, dp.Continuation{NextPartitionKey: entity.PartitionKey, NextRowKey: entity.RowKey}, nil
+		}
+		page = append(page, entity)
+	}
+	return page, dp.Continuation{}, nil
+}
+
+// SampleKeys returns the partition keys of the first limit entities inside queryRange
+func (source *MemorySource) SampleKeys(queryRange dp.QueryRange, limit int) ([]string, error) {
+	entities, err := source.ReadRange(queryRange)
+	if len(entities) > limit {
+		entities = entities[:limit]
+	}
+
+	keys := make([]string, len(entities))
+	for i, entity := range entities {
+		keys[i] = entity.PartitionKey
+	}
+	return keys, err
+}
+
+// MemorySink is an in-memory Sink keyed on the given key attributes
+type MemorySink struct {
+	KeyNames []string
+	Flushes  int
+
+	mutex sync.Mutex
+	items map[string]map[string]*dynamodb.AttributeValue
+}
+
+// NewMemorySink returns an empty sink. Items are keyed on PartitionKey and RowKey unless other key names are given.
+func NewMemorySink(keyNames ...string) *MemorySink {
+	if len(keyNames) == 0 {
+		keyNames = []string{"PartitionKey", "RowKey"}
+	}
+
+	return &MemorySink{
+		KeyNames: keyNames,
+		items:    map[string]map[string]*dynamodb.AttributeValue{},
+	}
+}
+
+func (sink *MemorySink) itemKey(item map[string]*dynamodb.AttributeValue) string {
+	parts := make([]string, len(sink.KeyNames))
+	for i, name := range sink.KeyNames {
+		if value, ok := item[name]; ok {
+			parts[i] = value.String()
+		}
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// VerifyKeys checks that the sink is keyed on keyNames
+func (sink *MemorySink) VerifyKeys(keyNames []string) error {
+	if strings.Join(keyNames, ",") != strings.Join(sink.KeyNames, ",") {
+		return fmt.Errorf("sink is keyed on %v, not %v", sink.KeyNames, keyNames)
+	}
+	return nil
+}
+
+// WriteBatch stores items, replacing any item with the same key
+func (sink *MemorySink) WriteBatch(items []map[string]*dynamodb.AttributeValue) ([]map[string]*dynamodb.AttributeValue, error) {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	for _, item := range items {
+		sink.items[sink.itemKey(item)] = item
+	}
+	return nil, nil
+}
+
+// DeleteBatch removes the items identified by keys
+func (sink *MemorySink) DeleteBatch(keys []map[string]*dynamodb.AttributeValue) ([]map[string]*dynamodb.AttributeValue, error) {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	for _, key := range keys {
+		delete(sink.items, sink.itemKey(key))
+	}
+	return nil, nil
+}
+
+// Flush counts how often the sink has been flushed
+func (sink *MemorySink) Flush() error {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	sink.Flushes++
+	return nil
+}
+
+// Items returns every item currently stored in the sink
+func (sink *MemorySink) Items() []map[string]*dynamodb.AttributeValue {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	items := make([]map[string]*dynamodb.AttributeValue, 0, len(sink.items))
+	for _, item := range sink.items {
+		items = append(items, item)
+	}
+	return items
+}
+
+// MemoryStatus is an in-memory StatusStore
+type MemoryStatus struct {
+	mutex   sync.Mutex
+	records map[dp.QueryRange]dp.RangeRecord
+}
+
+// NewMemoryStatus returns a status store that already holds the given records
+func NewMemoryStatus(records ...dp.RangeRecord) *MemoryStatus {
+	status := &MemoryStatus{records: map[dp.QueryRange]dp.RangeRecord{}}
+	for _, record := range records {
+		status.records[record.QueryRange] = record
+	}
+	return status
+}
+
+// NewMigrationStatusTable is a no-op, the in-memory status needs no setup
+func (status *MemoryStatus) NewMigrationStatusTable() error {
+	return nil
+}
+
+// ScanStatusTable returns every range record
+func (status *MemoryStatus) ScanStatusTable() []dp.RangeRecord {
+	status.mutex.Lock()
+	defer status.mutex.Unlock()
+
+	records := make([]dp.RangeRecord, 0, len(status.records))
+	for _, record := range status.records {
+		records = append(records, record)
+	}
+	return records
+}
+
+// WriteRangeRecord stores record, replacing any earlier record of the same range unless another owner holds it
+func (status *MemoryStatus) WriteRangeRecord(record dp.RangeRecord) {
+	status.mutex.Lock()
+	defer status.mutex.Unlock()
+
+	if previous, found := status.records[record.QueryRange]; found && !previous.HeldBy(record.LeaseOwner) {
+		return
+	}
+	status.records[record.QueryRange] = record
+}
+
+// CheckpointRange stores the checkpoint and counts of record on the record of its range
+func (status *MemoryStatus) CheckpointRange(record dp.RangeRecord) error {
+	status.mutex.Lock()
+	defer status.mutex.Unlock()
+
+	checkpointed, found := status.records[record.QueryRange]
+	if found && !checkpointed.HeldBy(record.LeaseOwner) {
+		return dp.ErrLeaseLost
+	}
+	if !found {
+		checkpointed = dp.RangeRecord{QueryRange: record.QueryRange, Status: dp.RangeIncomplete, Attempt: record.Attempt}
+	}
+
+	checkpointed.Checkpoint = record.Checkpoint
+	checkpointed.ItemsRead = record.ItemsRead
+	checkpointed.ItemsWritten = record.ItemsWritten
+	checkpointed.ItemsRejected = record.ItemsRejected
+	checkpointed.Bytes = record.Bytes
+	status.records[record.QueryRange] = checkpointed
+	return nil
+}
+
+// ClaimRange leases queryRange to identity if it has no record yet or its record is claimable
+func (status *MemoryStatus) ClaimRange(queryRange dp.QueryRange, identity dp.Identity, expires time.Time, maxAttempts int) (dp.RangeRecord, bool, error) {
+	status.mutex.Lock()
+	defer status.mutex.Unlock()
+
+	previous, found := status.records[queryRange]
+	if found && !previous.Claimable(time.Now(), maxAttempts) {
+		return previous, false, nil
+	}
+
+	claimed := previous
+	claimed.QueryRange = queryRange
+	claimed.Status = dp.RangeLeased
+	claimed.Attempt++
+	claimed.LeaseOwner = identity.Owner()
+	claimed.LeaseExpires = expires.Unix()
+	status.records[queryRange] = claimed
+
+	return previous, true, nil
+}
+
+// RenewLease extends the lease identity holds on queryRange
+func (status *MemoryStatus) RenewLease(queryRange dp.QueryRange, identity dp.Identity, expires time.Time) (bool, error) {
+	status.mutex.Lock()
+	defer status.mutex.Unlock()
+
+	record, found := status.records[queryRange]
+	if !found || record.Status != dp.RangeLeased || record.LeaseOwner != identity.Owner() {
+		return false, nil
+	}
+
+	record.LeaseExpires = expires.Unix()
+	status.records[queryRange] = record
+	return true, nil
+}
+
+// Record returns the record of queryRange, if there is one
+func (status *MemoryStatus) Record(queryRange dp.QueryRange) (dp.RangeRecord, bool) {
+	status.mutex.Lock()
+	defer status.mutex.Unlock()
+
+	record, ok := status.records[queryRange]
+	return record, ok
+}
@@ -0,0 +1,89 @@
+package dptest
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	dp "github.com/ImagineLearning/tablestorage-to-dynamo/internal/pkg/dataprovider"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestMemorySinkReplacesAndDeletesByKey(t *testing.T) {
+	sink := NewMemorySink()
+	key := map[string]*dynamodb.AttributeValue{
+		"PartitionKey": {S: aws.String("00a")},
+		"RowKey":       {S: aws.String("1")},
+	}
+	item := map[string]*dynamodb.AttributeValue{
+		"PartitionKey": key["PartitionKey"],
+		"RowKey":       key["RowKey"],
+		"Name":         {S: aws.String("first")},
+	}
+
+	sink.WriteBatch([]map[string]*dynamodb.AttributeValue{item, item})
+	if items := sink.Items(); len(items) != 1 {
+		t.Errorf("Expected items with the same key to replace each other, got %v items", len(items))
+	}
+
+	sink.DeleteBatch([]map[string]*dynamodb.AttributeValue{key})
+	if items := sink.Items(); len(items) != 0 {
+		t.Errorf("Expected item to be deleted, got %v items", len(items))
+	}
+}
+
+func TestMemorySourceReadsPages(t *testing.T) {
+	source := NewMemorySource()
+	source.PageSize = 2
+	for _, key := range []string{"00", "01", "01", "02", "05"} {
+		source.Add(&storage.Entity{PartitionKey: key, RowKey: fmt.Sprint(len(source.entities))})
+	}
+
+	pages := 0
+	keys := []string{}
+	next := dp.Continuation{}
+	for {
+		page, following, err := source.ReadPage(dp.NewQueryRange("01", "05"), next)
+		if err != nil {
+			t.Fatalf("Could not read page: %v", err)
+		}
+
+		pages++
+		for _, entity := range page {
+			keys = append(keys, entity.PartitionKey+"/"+entity.RowKey)
+		}
+
+		if next = following; next.IsZero() {
+			break
+		}
+	}
+
+	if pages != 2 || strings.Join(keys, ",") != "01/1,01/2,02/3" {
+		t.Errorf("Expected 01/1,01/2,02/3 in 2 pages, got %v in %v", keys, pages)
+	}
+}
+
+func TestStatusWritesRequireTheLease(t *testing.T) {
+	queryRange := dp.NewQueryRange("0", "g")
+	status := NewMemoryStatus()
+	if _, ok, _ := status.ClaimRange(queryRange, dp.Identity{JobID: "job", Host: "new"}, time.Now().Add(time.Minute), 3); !ok {
+		t.Fatalf("Expected the range to be claimed")
+	}
+
+	stale := dp.RangeRecord{QueryRange: queryRange, Status: dp.RangeCompleted, LeaseOwner: "job@old"}
+	if err := status.CheckpointRange(stale); err != dp.ErrLeaseLost {
+		t.Errorf("Expected a checkpoint of a lost lease to fail, got %v", err)
+	}
+	status.WriteRangeRecord(stale)
+	if record, _ := status.Record(queryRange); record.Status != dp.RangeLeased || record.LeaseOwner != "job@new" {
+		t.Errorf("Expected the record of the new owner to be kept, got %+v", record)
+	}
+
+	status.WriteRangeRecord(dp.RangeRecord{QueryRange: queryRange, Status: dp.RangeCompleted, LeaseOwner: "job@new"})
+	if record, _ := status.Record(queryRange); record.Status != dp.RangeCompleted {
+		t.Errorf("Expected the owner to record the range, got %+v", record)
+	}
+}
@@ -2,7 +2,10 @@ package dataprovider
 
 import (
 	"errors"
+	"fmt"
 	"log"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -12,6 +15,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
 )
 
 // GetWriteRequests typecast func for building delete and write request structs
@@ -20,40 +24,55 @@ type GetWriteRequests func(input []map[string]*dynamodb.AttributeValue) []*dynam
 // DynamoConfig config data for dynamo connection and status table name
 type DynamoConfig struct {
 	Region                   string `default:"us-west-2"`
+	Endpoint                 string // overrides the regional endpoint, i.e. http://localhost:8000 for DynamoDB Local
 	TableName                string `required:"true"`
 	MigrationStatusTableName string `require:"true"`
+	WriteRetry               RetryPolicy
 }
 
 var (
 	batchWriteSize = 25
 	batchReadSize  = 100
+
+	// ErrUnprocessedItems is returned when dynamo still reports unprocessed items after every retry
+	ErrUnprocessedItems = errors.New("dynamo left items unprocessed after all retries")
 )
 
 // DynamoProvider contains service for all dynamo calls and table name
 type DynamoProvider struct {
-	Service   *dynamodb.DynamoDB
+	Service   dynamodbiface.DynamoDBAPI
 	TableName string
+	Retry     RetryPolicy
+}
+
+func newDynamoService(config DynamoConfig) *dynamodb.DynamoDB {
+	awsConfig := &aws.Config{
+		Region:      aws.String(config.Region),
+		Credentials: credentials.NewEnvCredentials(),
+	}
+
+	if config.Endpoint != "" {
+		awsConfig.Endpoint = aws.String(config.Endpoint)
+	}
+
+	return dynamodb.New(session.New(awsConfig))
 }
 
 // NewDynamoProvider connects to a dynamo service provider and returns new DynamoProvider struct
 func NewDynamoProvider(config DynamoConfig) DynamoProvider {
 	return DynamoProvider{
-		Service: dynamodb.New(session.New(&aws.Config{
-			Region:      aws.String(config.Region),
-			Credentials: credentials.NewEnvCredentials(),
-		})),
+		Service:   newDynamoService(config),
 		TableName: config.TableName,
+		Retry:     config.WriteRetry,
 	}
 }
 
 // NewMigrationStatusProvider connects to a dynamo service provider using the migration status table name
 func NewMigrationStatusProvider(config DynamoConfig) DynamoProvider {
 	return DynamoProvider{
-		Service: dynamodb.New(session.New(&aws.Config{
-			Region:      aws.String(config.Region),
-			Credentials: credentials.NewEnvCredentials(),
-		})),
+		Service:   newDynamoService(config),
 		TableName: config.MigrationStatusTableName,
+		Retry:     config.WriteRetry,
 	}
 }
 
@@ -163,9 +182,36 @@ func (dynamoProvider *DynamoProvider) DeleteMigrationStatusTable() error {
 	return nil
 }
 
-// ScanStatusTable reads all ranges from status table
-func (dynamoProvider *DynamoProvider) ScanStatusTable() []QueryRange {
-	migrationStatus := []QueryRange{}
+// VerifyKeys describes the table and checks that it is keyed on keyNames, hash key first
+func (dynamoProvider *DynamoProvider) VerifyKeys(keyNames []string) error {
+	response, err := dynamoProvider.Service.DescribeTable(&dynamodb.DescribeTableInput{
+		TableName: &dynamoProvider.TableName,
+	})
+
+	if err != nil || response.Table == nil {
+		return fmt.Errorf("could not describe table %v: %v", dynamoProvider.TableName, err)
+	}
+
+	tableKeys := make([]string, len(response.Table.KeySchema))
+	for _, element := range response.Table.KeySchema {
+		position := 0
+		if aws.StringValue(element.KeyType) == dynamodb.KeyTypeRange {
+			position = 1
+		}
+		if position < len(tableKeys) {
+			tableKeys[position] = aws.StringValue(element.AttributeName)
+		}
+	}
+
+	if strings.Join(tableKeys, ",") != strings.Join(keyNames, ",") {
+		return fmt.Errorf("table %v is keyed on %v, not %v", dynamoProvider.TableName, tableKeys, keyNames)
+	}
+	return nil
+}
+
+// ScanStatusTable reads all range records from status table
+func (dynamoProvider *DynamoProvider) ScanStatusTable() []RangeRecord {
+	migrationStatus := []RangeRecord{}
 
 	input := &dynamodb.ScanInput{
 		TableName: &dynamoProvider.TableName,
@@ -194,7 +240,7 @@ func (dynamoProvider *DynamoProvider) ScanStatusTable() []QueryRange {
 			log.Printf("Cannot read entries from status table: %v", err)
 		}
 
-		nextPage := []QueryRange{}
+		nextPage := []RangeRecord{}
 		err = dynamodbattribute.UnmarshalListOfMaps(response.Items, &nextPage)
 		if err != nil {
 			log.Printf("failed to unmarshal Dynamodb Scan Items, %v", err)
@@ -252,40 +298,220 @@ func (dynamoProvider *DynamoProvider) PutItem(item map[string]*dynamodb.Attribut
 	}
 }
 
-// WriteQueryRangeSuccess upon successful migration of query ranges writes this range to the migration status table.
-func (dynamoProvider *DynamoProvider) WriteQueryRangeSuccess(queryRange QueryRange) {
-	item := map[string]*dynamodb.AttributeValue{
+// WriteRangeRecord writes the outcome of migrating a query range to the migration status table. Records with a
+// lease owner are only written while no other owner holds the range.
+func (dynamoProvider *DynamoProvider) WriteRangeRecord(record RangeRecord) {
+	item, err := dynamodbattribute.MarshalMap(record)
+
+	if err != nil {
+		log.Printf("failed to marshal range record, %v", err)
+		return
+	}
+
+	if record.LeaseOwner == "" {
+		dynamoProvider.PutItem(item)
+		return
+	}
+
+	_, err = dynamoProvider.Service.PutItem(&dynamodb.PutItemInput{
+		Item:                      item,
+		TableName:                 &dynamoProvider.TableName,
+		ConditionExpression:       aws.String(leaseHeldCondition),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":owner": {S: aws.String(record.LeaseOwner)}},
+	})
+
+	if isConditionalCheckFailed(err) {
+		log.Printf("Range ge: %v and lt: %v was taken over by another process, not recording it as %v", record.Ge, record.Lt, record.Status)
+	} else if err != nil {
+		log.Printf("Could not record range ge: %v and lt: %v: %v", record.Ge, record.Lt, err)
+	}
+}
+
+// leaseHeldCondition only lets the owner of a lease, or any process if the range has no owner, update its record
+const leaseHeldCondition = "attribute_not_exists(LeaseOwner) OR LeaseOwner = :owner"
+
+func isRetryableWriteError(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case dynamodb.ErrCodeProvisionedThroughputExceededException, dynamodb.ErrCodeInternalServerError, "ThrottlingException", "RequestLimitExceeded":
+			return true
+		}
+	}
+	return false
+}
+
+func countWriteRequests(requestItems map[string][]*dynamodb.WriteRequest) int {
+	count := 0
+	for _, requests := range requestItems {
+		count += len(requests)
+	}
+	return count
+}
+
+func statusKey(queryRange QueryRange) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
 		"Ge": {S: aws.String(queryRange.Ge)},
 		"Lt": {S: aws.String(queryRange.Lt)},
 	}
-	dynamoProvider.PutItem(item)
 }
 
-// BatchWrite writes a batch to dynamo. Batches are 25 entries
-func (dynamoProvider *DynamoProvider) BatchWrite(input map[string][]*dynamodb.WriteRequest) {
-	writeInput := &dynamodb.BatchWriteItemInput{RequestItems: input}
-	result, err := dynamoProvider.Service.BatchWriteItem(writeInput)
+func isConditionalCheckFailed(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
+
+// CheckpointRange stores the checkpoint and counts of record with an update that leaves the status and lease of the
+// range alone. The status is only set if the range has no record yet, so a crash isn't mistaken for completion.
+// Records with a lease owner are only checkpointed while no other owner holds the range.
+func (dynamoProvider *DynamoProvider) CheckpointRange(record RangeRecord) error {
+	checkpoint, err := dynamodbattribute.Marshal(record.Checkpoint)
 
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			case dynamodb.ErrCodeProvisionedThroughputExceededException:
-				log.Println(dynamodb.ErrCodeProvisionedThroughputExceededException, aerr.Error())
-			case dynamodb.ErrCodeResourceNotFoundException:
-				log.Println(dynamodb.ErrCodeResourceNotFoundException, aerr.Error())
-			case dynamodb.ErrCodeItemCollectionSizeLimitExceededException:
-				log.Println(dynamodb.ErrCodeItemCollectionSizeLimitExceededException, aerr.Error())
-			case dynamodb.ErrCodeInternalServerError:
-				log.Println(dynamodb.ErrCodeInternalServerError, aerr.Error())
-			default:
-				log.Println(aerr.Error())
+		return err
+	}
+
+	input := &dynamodb.UpdateItemInput{
+		TableName: &dynamoProvider.TableName,
+		Key:       statusKey(record.QueryRange),
+		UpdateExpression: aws.String("SET #checkpoint = :checkpoint, ItemsRead = :read, ItemsWritten = :written, ItemsRejected = :rejected, Bytes = :bytes, " +
+			"#status = if_not_exists(#status, :incomplete), Attempt = if_not_exists(Attempt, :attempt)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#status":     aws.String("Status"),
+			"#checkpoint": aws.String("Checkpoint"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":checkpoint": checkpoint,
+			":read":       {N: aws.String(strconv.Itoa(record.ItemsRead))},
+			":written":    {N: aws.String(strconv.Itoa(record.ItemsWritten))},
+			":rejected":   {N: aws.String(strconv.Itoa(record.ItemsRejected))},
+			":bytes":      {N: aws.String(strconv.Itoa(record.Bytes))},
+			":incomplete": {S: aws.String(string(RangeIncomplete))},
+			":attempt":    {N: aws.String(strconv.Itoa(record.Attempt))},
+		},
+	}
+
+	if record.LeaseOwner != "" {
+		input.ConditionExpression = aws.String(leaseHeldCondition)
+		input.ExpressionAttributeValues[":owner"] = &dynamodb.AttributeValue{S: aws.String(record.LeaseOwner)}
+	}
+
+	_, err = dynamoProvider.Service.UpdateItem(input)
+	if isConditionalCheckFailed(err) {
+		return ErrLeaseLost
+	}
+	return err
+}
+
+// ClaimRange leases queryRange to identity with a conditional update that only succeeds if the range has no record
+// yet, it is planned or incomplete, its lease has expired, or it is partial or failed and has been attempted fewer
+// than maxAttempts times.
+func (dynamoProvider *DynamoProvider) ClaimRange(queryRange QueryRange, identity Identity, expires time.Time, maxAttempts int) (RangeRecord, bool, error) {
+	previous := RangeRecord{}
+	input := &dynamodb.UpdateItemInput{
+		TableName: &dynamoProvider.TableName,
+		Key:       statusKey(queryRange),
+		ConditionExpression: aws.String("attribute_not_exists(Ge) OR (#status = :leased AND LeaseExpires < :now) OR #status IN (:planned, :incomplete) OR " +
+			"((#status = :partial OR #status = :failed) AND Attempt < :maxAttempts)"),
+		UpdateExpression: aws.String("SET #status = :leased, LeaseOwner = :owner, LeaseExpires = :expires ADD Attempt :one"),
+		ExpressionAttributeNames: map[string]*string{
+			"#status": aws.String("Status"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":leased":      {S: aws.String(string(RangeLeased))},
+			":planned":     {S: aws.String(string(RangePlanned))},
+			":incomplete":  {S: aws.String(string(RangeIncomplete))},
+			":partial":     {S: aws.String(string(RangePartial))},
+			":failed":      {S: aws.String(string(RangeFailed))},
+			":now":         {N: aws.String(strconv.FormatInt(time.Now().Unix(), 10))},
+			":maxAttempts": {N: aws.String(strconv.Itoa(maxAttempts))},
+			":owner":       {S: aws.String(identity.Owner())},
+			":expires":     {N: aws.String(strconv.FormatInt(expires.Unix(), 10))},
+			":one":         {N: aws.String("1")},
+		},
+		ReturnValues: aws.String(dynamodb.ReturnValueAllOld),
+	}
+
+	result, err := dynamoProvider.Service.UpdateItem(input)
+
+	if err != nil {
+		if isConditionalCheckFailed(err) {
+			return previous, false, nil
+		}
+		return previous, false, err
+	}
+
+	err = dynamodbattribute.UnmarshalMap(result.Attributes, &previous)
+	return previous, true, err
+}
+
+// RenewLease pushes out the expiry of a lease identity holds on queryRange
+func (dynamoProvider *DynamoProvider) RenewLease(queryRange QueryRange, identity Identity, expires time.Time) (bool, error) {
+	input := &dynamodb.UpdateItemInput{
+		TableName:           &dynamoProvider.TableName,
+		Key:                 statusKey(queryRange),
+		ConditionExpression: aws.String("#status = :leased AND LeaseOwner = :owner"),
+		UpdateExpression:    aws.String("SET LeaseExpires = :expires"),
+		ExpressionAttributeNames: map[string]*string{
+			"#status": aws.String("Status"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":leased":  {S: aws.String(string(RangeLeased))},
+			":owner":   {S: aws.String(identity.Owner())},
+			":expires": {N: aws.String(strconv.FormatInt(expires.Unix(), 10))},
+		},
+	}
+
+	_, err := dynamoProvider.Service.UpdateItem(input)
+
+	if err != nil {
+		if isConditionalCheckFailed(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// BatchWrite writes a batch to dynamo. Batches are 25 entries. Unprocessed items and throttled calls are retried
+// with backoff until the retry budget is spent, whatever could not be written is returned to the caller.
+func (dynamoProvider *DynamoProvider) BatchWrite(input map[string][]*dynamodb.WriteRequest) (map[string][]*dynamodb.WriteRequest, error) {
+	for attempt := 1; ; attempt++ {
+		writeInput := &dynamodb.BatchWriteItemInput{RequestItems: input}
+		result, err := dynamoProvider.Service.BatchWriteItem(writeInput)
+
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); ok {
+				switch aerr.Code() {
+				case dynamodb.ErrCodeProvisionedThroughputExceededException:
+					log.Println(dynamodb.ErrCodeProvisionedThroughputExceededException, aerr.Error())
+				case dynamodb.ErrCodeResourceNotFoundException:
+					log.Println(dynamodb.ErrCodeResourceNotFoundException, aerr.Error())
+				case dynamodb.ErrCodeItemCollectionSizeLimitExceededException:
+					log.Println(dynamodb.ErrCodeItemCollectionSizeLimitExceededException, aerr.Error())
+				case dynamodb.ErrCodeInternalServerError:
+					log.Println(dynamodb.ErrCodeInternalServerError, aerr.Error())
+				default:
+					log.Println(aerr.Error())
+				}
+			} else {
+				log.Println(err.Error())
+			}
+
+			if !isRetryableWriteError(err) || attempt >= dynamoProvider.Retry.Attempts() {
+				return input, err
 			}
 		} else {
-			log.Println(err.Error())
+			if countWriteRequests(result.UnprocessedItems) == 0 {
+				return nil, nil
+			}
+
+			input = result.UnprocessedItems
+			if attempt >= dynamoProvider.Retry.Attempts() {
+				return input, ErrUnprocessedItems
+			}
 		}
-	}
-	if len(result.UnprocessedItems) > 0 {
-		dynamoProvider.BatchWrite(result.UnprocessedItems)
+
+		time.Sleep(dynamoProvider.Retry.Backoff(attempt))
 	}
 }
 
@@ -319,8 +545,14 @@ func GetDynamoDeleteRequests(input []map[string]*dynamodb.AttributeValue) []*dyn
 	return writeRequests
 }
 
-func (dynamoProvider *DynamoProvider) WriteToDynamo(input []map[string]*dynamodb.AttributeValue, fn GetWriteRequests) {
+// WriteToDynamo writes input in concurrent batches and returns the write requests that could not be processed
+// along with the last error seen.
+func (dynamoProvider *DynamoProvider) WriteToDynamo(input []map[string]*dynamodb.AttributeValue, fn GetWriteRequests) ([]*dynamodb.WriteRequest, error) {
 	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var lastErr error
+	failed := []*dynamodb.WriteRequest{}
+
 	for i := 0; i < len(input); i += batchWriteSize {
 		wg.Add(1)
 		go func(start int) {
@@ -331,9 +563,49 @@ func (dynamoProvider *DynamoProvider) WriteToDynamo(input []map[string]*dynamodb
 			writeRequestItems := map[string][]*dynamodb.WriteRequest{
 				dynamoProvider.TableName: fn(input[start:end]),
 			}
-			dynamoProvider.BatchWrite(writeRequestItems)
+			unprocessed, err := dynamoProvider.BatchWrite(writeRequestItems)
+
+			mutex.Lock()
+			for _, requests := range unprocessed {
+				failed = append(failed, requests...)
+			}
+			if err != nil {
+				lastErr = err
+			}
+			mutex.Unlock()
 			wg.Done()
 		}(i)
 	}
 	wg.Wait()
+
+	return failed, lastErr
+}
+
+func writeRequestsToItems(requests []*dynamodb.WriteRequest) []map[string]*dynamodb.AttributeValue {
+	items := make([]map[string]*dynamodb.AttributeValue, 0, len(requests))
+	for _, request := range requests {
+		if request.PutRequest != nil {
+			items = append(items, request.PutRequest.Item)
+		} else if request.DeleteRequest != nil {
+			items = append(items, request.DeleteRequest.Key)
+		}
+	}
+	return items
+}
+
+// WriteBatch puts items into the dynamo table and returns the items that could not be written
+func (dynamoProvider *DynamoProvider) WriteBatch(items []map[string]*dynamodb.AttributeValue) ([]map[string]*dynamodb.AttributeValue, error) {
+	failed, err := dynamoProvider.WriteToDynamo(items, GetDynamoPutRequests)
+	return writeRequestsToItems(failed), err
+}
+
+// DeleteBatch deletes the items identified by keys from the dynamo table and returns the keys that could not be deleted
+func (dynamoProvider *DynamoProvider) DeleteBatch(keys []map[string]*dynamodb.AttributeValue) ([]map[string]*dynamodb.AttributeValue, error) {
+	failed, err := dynamoProvider.WriteToDynamo(keys, GetDynamoDeleteRequests)
+	return writeRequestsToItems(failed), err
+}
+
+// Flush is a no-op, every batch is written to dynamo as soon as it is received
+func (dynamoProvider *DynamoProvider) Flush() error {
+	return nil
 }
@@ -1,14 +1,9 @@
 package dataprovider
 
 import (
-	"fmt"
 	"log"
-	"strconv"
-	"sync"
-	"time"
 
 	"github.com/Azure/azure-sdk-for-go/storage"
-	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 )
 
@@ -40,10 +35,12 @@ func (worker *DynamoReadWorker) Stop() {
 	}()
 }
 
-// DynamoWriteBatch represents a query range and corresponding entries in that range
+// DynamoWriteBatch is a batch of entries read from a query range, the progress of the range collects the outcome
+// of writing them
 type DynamoWriteBatch struct {
-	queryRange QueryRange
-	entities   []*storage.Entity
+	progress *rangeProgress
+	page     *pageProgress
+	entities []*storage.Entity
 }
 
 type DynamoWriteWork chan DynamoWriteBatch
@@ -65,43 +62,20 @@ func NewDynamoWriteWorker(id int, workerPool chan DynamoWriteWork) DynamoWriteWo
 	return worker
 }
 
-func storageEntityToDynamoKey(entity *storage.Entity) map[string]*dynamodb.AttributeValue {
-	return map[string]*dynamodb.AttributeValue{
-		"PartitionKey": {S: aws.String(entity.PartitionKey)},
-		"RowKey":       {S: aws.String(entity.RowKey)},
+// writeOutcome classifies a range from how many of its entities could not be written. An error without failed
+// entities leaves it unknown what landed, so the range counts as failed.
+func writeOutcome(total int, failed int, err error) RangeStatus {
+	switch {
+	case failed == 0 && err == nil:
+		return RangeCompleted
+	case failed > 0 && failed < total:
+		return RangePartial
+	default:
+		return RangeFailed
 	}
 }
 
-func storageEntityToDynamoMap(entity *storage.Entity, columnNames *[]string) map[string]*dynamodb.AttributeValue {
-	dynamoMap := map[string]*dynamodb.AttributeValue{
-		"PartitionKey": {S: aws.String(entity.PartitionKey)},
-		"RowKey":       {S: aws.String(entity.RowKey)},
-		"Timestamp":    {S: aws.String(entity.TimeStamp.UTC().Format("2006-01-02T15:04:05.999999Z"))},
-	}
-
-	for _, key := range *columnNames {
-		switch value := entity.Properties[key].(type) {
-		case string:
-			if value != "" {
-				dynamoMap[key] = &dynamodb.AttributeValue{S: aws.String(value)}
-			}
-		case int32:
-			dynamoMap[key] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(int64(value), 10))}
-		case int64:
-			dynamoMap[key] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(value, 10))}
-		case float64:
-			dynamoMap[key] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatFloat(value, 'f', -1, 64))}
-		case bool:
-			dynamoMap[key] = &dynamodb.AttributeValue{BOOL: aws.Bool(value)}
-		case time.Time:
-			dynamoMap[key] = &dynamodb.AttributeValue{S: aws.String(value.UTC().Format("2006-01-02T15:04:05.999999Z"))}
-		}
-	}
-
-	return dynamoMap
-}
-
-func (worker *DynamoWriteWorker) Start(dynamo *DynamoProvider, status *DynamoProvider, columnNames *[]string, wg *sync.WaitGroup) {
+func (worker *DynamoWriteWorker) Start(sink Sink, mapping *Mapping) {
 	go func() {
 		for {
 			worker.WorkerPool <- worker.Work
@@ -109,25 +83,64 @@ func (worker *DynamoWriteWorker) Start(dynamo *DynamoProvider, status *DynamoPro
 			case writeBatch := <-worker.Work:
 				log.Printf("Write worker %v: Recieved write work request for %v entities\n", worker.ID, len(writeBatch.entities))
 
-				dynamoMapList := make([]map[string]*dynamodb.AttributeValue, len(writeBatch.entities))
-				for i, entity := range writeBatch.entities {
-					dynamoMapList[i] = storageEntityToDynamoMap(entity, columnNames)
+				dynamoMapList := make([]map[string]*dynamodb.AttributeValue, 0, len(writeBatch.entities))
+				var convertErr error
+				unconverted := 0
+				rejected := 0
+				for _, entity := range writeBatch.entities {
+					item, err := storageEntityToDynamoMap(entity, mapping)
+					if err == nil && item == nil {
+						// expired entities are skipped
+						continue
+					}
+					if err == nil {
+						// items too big for dynamo would fail the whole batch they are sent in
+						var items []map[string]*dynamodb.AttributeValue
+						items, err = mapping.LargeItems.items(item)
+						dynamoMapList = append(dynamoMapList, items...)
+						if err == nil && len(items) == 0 {
+							rejected++
+						}
+					}
+
+					if err != nil {
+						log.Printf("Write worker %v: Could not convert entity %v/%v: %v\n", worker.ID, entity.PartitionKey, entity.RowKey, err)
+						convertErr = err
+						unconverted++
+					}
 				}
 
-				dynamo.WriteToDynamo(dynamoMapList, GetDynamoPutRequests)
-				status.WriteQueryRangeSuccess(writeBatch.queryRange)
+				var failed []map[string]*dynamodb.AttributeValue
+				var err error
+				if len(dynamoMapList) > 0 {
+					failed, err = sink.WriteBatch(dynamoMapList)
+				}
 
+				if len(failed) > 0 || err != nil {
+					queryRange := writeBatch.progress.queryRange()
+					log.Printf("Write worker %v: Could not write %v entities in range ge: %v and lt: %v: %v\n", worker.ID, len(failed), queryRange.Ge, queryRange.Lt, err)
+				}
+
+				if err == nil {
+					err = convertErr
+				}
+
+				// chunked items are written as several, count no more failures than there are entities
+				failedEntities := len(failed) + unconverted
+				if failedEntities > len(writeBatch.entities) {
+					failedEntities = len(writeBatch.entities)
+				}
+				writeBatch.progress.written(writeBatch.page, len(writeBatch.entities), failedEntities, rejected, itemsSize(dynamoMapList)-itemsSize(failed), err)
 				log.Printf("Write worker %v: Finished write work request for %v entities\n", worker.ID, len(writeBatch.entities))
-				wg.Done()
 			case <-worker.QuitChan:
-				fmt.Printf("worker%d: Stopping.", worker.ID)
+				log.Printf("worker%d: Stopping.", worker.ID)
 				return
 			}
 		}
 	}()
 }
 
-func (worker *DynamoWriteWorker) StartDelete(dynamo *DynamoProvider, wg *sync.WaitGroup) {
+func (worker *DynamoWriteWorker) StartDelete(sink Sink, mapping *Mapping) {
 	go func() {
 		for {
 			worker.WorkerPool <- worker.Work
@@ -137,15 +150,20 @@ func (worker *DynamoWriteWorker) StartDelete(dynamo *DynamoProvider, wg *sync.Wa
 
 				dynamoMapList := make([]map[string]*dynamodb.AttributeValue, len(writeBatch.entities))
 				for i, entity := range writeBatch.entities {
-					dynamoMapList[i] = storageEntityToDynamoKey(entity)
+					dynamoMapList[i] = storageEntityToDynamoKey(entity, mapping)
 				}
 
-				dynamo.WriteToDynamo(dynamoMapList, GetDynamoDeleteRequests)
+				failed, err := sink.DeleteBatch(dynamoMapList)
+
+				if len(failed) > 0 || err != nil {
+					queryRange := writeBatch.progress.queryRange()
+					log.Printf("Write worker %v: Could not delete %v entities in range ge: %v and lt: %v: %v\n", worker.ID, len(failed), queryRange.Ge, queryRange.Lt, err)
+				}
 
+				writeBatch.progress.written(writeBatch.page, len(dynamoMapList), len(failed), 0, 0, err)
 				log.Printf("Write worker %v: Finished delete work request for %v entities\n", worker.ID, len(writeBatch.entities))
-				wg.Done()
 			case <-worker.QuitChan:
-				fmt.Printf("worker%d: Stopping.", worker.ID)
+				log.Printf("worker%d: Stopping.", worker.ID)
 				return
 			}
 		}
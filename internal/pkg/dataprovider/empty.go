@@ -0,0 +1,112 @@
+package dataprovider
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// EmptyAction is what an EmptyPolicy does with an empty string or a null
+type EmptyAction string
+
+const (
+	// EmptyOmit leaves the attribute out of the item, as if the entity didn't have the property
+	EmptyOmit EmptyAction = "omit"
+	// EmptyNull stores the attribute as NULL
+	EmptyNull EmptyAction = "null"
+	// EmptyString stores the attribute as an empty string
+	EmptyString EmptyAction = "empty"
+	// EmptySentinel stores the policy's sentinel instead
+	EmptySentinel EmptyAction = "sentinel"
+)
+
+// EmptyPolicy decides what empty strings or nulls are migrated to. The zero value omits them.
+type EmptyPolicy struct {
+	Action   EmptyAction
+	Sentinel string // stored by EmptySentinel, converted to the column's type like any other string
+}
+
+// ParseEmptyPolicy parses omit, null, empty or sentinel=<value> in any case, an empty policy omits
+func ParseEmptyPolicy(policy string) (EmptyPolicy, error) {
+	action := strings.ToLower(strings.TrimSpace(policy))
+	if strings.HasPrefix(action, string(EmptySentinel)+"=") {
+		return EmptyPolicy{Action: EmptySentinel, Sentinel: policy[strings.Index(policy, "=")+1:]}, nil
+	}
+
+	switch EmptyAction(action) {
+	case "", EmptyOmit:
+		return EmptyPolicy{Action: EmptyOmit}, nil
+	case EmptyNull, EmptyString:
+		return EmptyPolicy{Action: EmptyAction(action)}, nil
+	}
+	return EmptyPolicy{}, fmt.Errorf("unknown empty value policy %q, use omit, null, empty or sentinel=<value>", policy)
+}
+
+// attribute returns what the policy stores for a column of attributeType, nil to omit it
+func (policy EmptyPolicy) attribute(attributeType AttributeType) (*dynamodb.AttributeValue, error) {
+	switch policy.Action {
+	case EmptyNull:
+		return &dynamodb.AttributeValue{NULL: aws.Bool(true)}, nil
+	case EmptyString:
+		return columnAttribute("", attributeType)
+	case EmptySentinel:
+		return columnAttribute(policy.Sentinel, attributeType)
+	}
+	return nil, nil
+}
+
+// EmptyValues holds the policies for empty strings and nulls, globally and per column
+type EmptyValues struct {
+	Strings       EmptyPolicy
+	Nulls         EmptyPolicy
+	ColumnStrings map[string]EmptyPolicy // override Strings for single columns
+	ColumnNulls   map[string]EmptyPolicy // override Nulls for single columns
+}
+
+// ParseEmptyValues parses global and per column policies as ParseEmptyPolicy understands them
+func ParseEmptyValues(emptyStrings string, nulls string, columnStrings map[string]string, columnNulls map[string]string) (EmptyValues, error) {
+	values := EmptyValues{}
+
+	var err error
+	if values.Strings, err = ParseEmptyPolicy(emptyStrings); err != nil {
+		return values, err
+	}
+	if values.Nulls, err = ParseEmptyPolicy(nulls); err != nil {
+		return values, err
+	}
+	if values.ColumnStrings, err = parseColumnPolicies(columnStrings); err != nil {
+		return values, err
+	}
+	values.ColumnNulls, err = parseColumnPolicies(columnNulls)
+	return values, err
+}
+
+func parseColumnPolicies(policies map[string]string) (map[string]EmptyPolicy, error) {
+	parsed := make(map[string]EmptyPolicy, len(policies))
+	for column, policy := range policies {
+		var err error
+		if parsed[column], err = ParseEmptyPolicy(policy); err != nil {
+			return nil, fmt.Errorf("column %v: %v", column, err)
+		}
+	}
+	return parsed, nil
+}
+
+// policy returns the policy that applies to value of column and whether value is empty at all
+func (values EmptyValues) policy(column string, value interface{}) (EmptyPolicy, bool) {
+	switch value {
+	case nil:
+		if policy, found := values.ColumnNulls[column]; found {
+			return policy, true
+		}
+		return values.Nulls, true
+	case "":
+		if policy, found := values.ColumnStrings[column]; found {
+			return policy, true
+		}
+		return values.Strings, true
+	}
+	return EmptyPolicy{}, false
+}
@@ -0,0 +1,103 @@
+package dataprovider
+
+import (
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/satori/go.uuid"
+)
+
+// attributeValueSize estimates the size dynamo accounts for a value, following
+// https://docs.aws.amazon.com/amazondynamodb/latest/developerguide/CapacityUnitCalculations.html
+func attributeValueSize(value *dynamodb.AttributeValue) int {
+	if value == nil {
+		return 0
+	}
+
+	size := 0
+	switch {
+	case value.S != nil:
+		size = len(*value.S)
+	case value.N != nil:
+		size = numberSize(*value.N)
+	case value.B != nil:
+		size = len(value.B)
+	case value.BOOL != nil, value.NULL != nil:
+		size = 1
+	case value.M != nil:
+		size = 3
+		for name, nested := range value.M {
+			size += len(name) + attributeValueSize(nested) + 1
+		}
+	case value.L != nil:
+		size = 3
+		for _, nested := range value.L {
+			size += attributeValueSize(nested) + 1
+		}
+	case value.SS != nil:
+		for _, member := range value.SS {
+			size += len(*member)
+		}
+	case value.NS != nil:
+		for _, member := range value.NS {
+			size += numberSize(*member)
+		}
+	case value.BS != nil:
+		for _, member := range value.BS {
+			size += len(member)
+		}
+	}
+	return size
+}
+
+func numberSize(number string) int {
+	digits := len(strings.TrimLeft(strings.NewReplacer("-", "", ".", "").Replace(number), "0"))
+	return (digits+1)/2 + 1
+}
+
+// ItemSize estimates the size of an item as dynamo accounts for it, the sum of its attribute names and values
+func ItemSize(item map[string]*dynamodb.AttributeValue) int {
+	size := 0
+	for name, value := range item {
+		size += len(name) + attributeValueSize(value)
+	}
+	return size
+}
+
+func itemsSize(items []map[string]*dynamodb.AttributeValue) int {
+	size := 0
+	for _, item := range items {
+		size += ItemSize(item)
+	}
+	return size
+}
+
+// entitySize estimates the size of a table storage entity from its keys, property names and values
+func entitySize(entity *storage.Entity) int {
+	size := len(entity.PartitionKey) + len(entity.RowKey)
+	for name, value := range entity.Properties {
+		size += len(name)
+		switch value := value.(type) {
+		case string:
+			size += len(value)
+		case []byte:
+			size += len(value)
+		case bool:
+			size++
+		case uuid.UUID:
+			size += 16
+		default:
+			size += 8
+		}
+	}
+	return size
+}
+
+func entitiesSize(entities []*storage.Entity) int {
+	size := 0
+	for _, entity := range entities {
+		size += entitySize(entity)
+	}
+	return size
+}
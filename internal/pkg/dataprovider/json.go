@@ -0,0 +1,152 @@
+package dataprovider
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// JSONFallback is what happens to values of JSON columns that can't be decoded
+type JSONFallback string
+
+const (
+	// JSONKeep migrates the value as if the column had no type override
+	JSONKeep JSONFallback = "keep"
+	// JSONNull stores NULL instead
+	JSONNull JSONFallback = "null"
+	// JSONSkip leaves the value out and reports the column as skipped
+	JSONSkip JSONFallback = "skip"
+	// JSONFail fails the entity
+	JSONFail JSONFallback = "fail"
+)
+
+// ParseJSONFallback parses keep, null, skip or fail in any case, an empty fallback keeps
+func ParseJSONFallback(fallback string) (JSONFallback, error) {
+	parsed := JSONFallback(strings.ToLower(strings.TrimSpace(fallback)))
+	switch parsed {
+	case "":
+		return JSONKeep, nil
+	case JSONKeep, JSONNull, JSONSkip, JSONFail:
+		return parsed, nil
+	}
+	return "", fmt.Errorf("unknown invalid JSON fallback %q, use keep, null, skip or fail", fallback)
+}
+
+func (attributeType AttributeType) isJSON() bool {
+	switch attributeType {
+	case TypeJSON, TypeMap, TypeList, TypeStringSet, TypeNumberSet:
+		return true
+	}
+	return false
+}
+
+// jsonAttribute decodes the JSON in text to attributeType, TypeJSON takes whatever text holds
+func jsonAttribute(text string, attributeType AttributeType) (*dynamodb.AttributeValue, error) {
+	decoder := json.NewDecoder(strings.NewReader(text))
+	decoder.UseNumber()
+
+	var decoded interface{}
+	if err := decoder.Decode(&decoded); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, fmt.Errorf("invalid JSON: trailing data")
+	}
+
+	switch attributeType {
+	case TypeMap:
+		if _, ok := decoded.(map[string]interface{}); !ok {
+			return nil, fmt.Errorf("JSON is not an object")
+		}
+	case TypeList:
+		if _, ok := decoded.([]interface{}); !ok {
+			return nil, fmt.Errorf("JSON is not an array")
+		}
+	case TypeStringSet, TypeNumberSet:
+		return jsonSet(decoded, attributeType)
+	}
+	return jsonValueAttribute(decoded), nil
+}
+
+// jsonValueAttribute converts a decoded JSON value, objects become M and arrays L
+func jsonValueAttribute(value interface{}) *dynamodb.AttributeValue {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		attributes := make(map[string]*dynamodb.AttributeValue, len(value))
+		for name, nested := range value {
+			attributes[name] = jsonValueAttribute(nested)
+		}
+		return &dynamodb.AttributeValue{M: attributes}
+	case []interface{}:
+		attributes := make([]*dynamodb.AttributeValue, len(value))
+		for i, nested := range value {
+			attributes[i] = jsonValueAttribute(nested)
+		}
+		return &dynamodb.AttributeValue{L: attributes}
+	case string:
+		return &dynamodb.AttributeValue{S: aws.String(value)}
+	case json.Number:
+		return numberAttribute(value.String())
+	case bool:
+		return &dynamodb.AttributeValue{BOOL: aws.Bool(value)}
+	}
+	return &dynamodb.AttributeValue{NULL: aws.Bool(true)}
+}
+
+// jsonSet converts a decoded JSON array of strings or numbers to a set. Duplicates are dropped, dynamo rejects them
+// just like empty sets.
+func jsonSet(value interface{}, attributeType AttributeType) (*dynamodb.AttributeValue, error) {
+	array, ok := value.([]interface{})
+	if !ok || len(array) == 0 {
+		return nil, fmt.Errorf("JSON is not a non empty array")
+	}
+
+	members := make([]*string, 0, len(array))
+	seen := make(map[string]bool, len(array))
+	for _, member := range array {
+		var text string
+		switch member := member.(type) {
+		case string:
+			if attributeType != TypeStringSet {
+				return nil, fmt.Errorf("JSON array holds %q, not only numbers", member)
+			}
+			text = member
+		case json.Number:
+			if attributeType != TypeNumberSet {
+				return nil, fmt.Errorf("JSON array holds %v, not only strings", member)
+			}
+			text = member.String()
+		default:
+			return nil, fmt.Errorf("JSON array holds %v, sets only hold strings or numbers", member)
+		}
+
+		if !seen[text] {
+			seen[text] = true
+			members = append(members, aws.String(text))
+		}
+	}
+
+	if attributeType == TypeStringSet {
+		return &dynamodb.AttributeValue{SS: members}, nil
+	}
+	return &dynamodb.AttributeValue{NS: members}, nil
+}
+
+// isJSONText reports whether value is a string holding a JSON object or array, used to point out JSON columns
+func isJSONText(value interface{}) bool {
+	text, ok := value.(string)
+	if !ok {
+		return false
+	}
+
+	trimmed := bytes.TrimSpace([]byte(text))
+	if len(trimmed) < 2 || !(trimmed[0] == '{' || trimmed[0] == '[') {
+		return false
+	}
+	return json.Valid(trimmed)
+}
@@ -0,0 +1,106 @@
+package dataprovider
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// keyPlaceholders expands the placeholders key templates may refer to
+func keyPlaceholders(entity *storage.Entity) *strings.Replacer {
+	return strings.NewReplacer("{PartitionKey}", entity.PartitionKey, "{RowKey}", entity.RowKey)
+}
+
+// KeySchema describes the key attributes of the target table and how their values are built from the keys of an
+// entity. Templates may refer to {PartitionKey} and {RowKey}. The zero value writes PartitionKey and RowKey as they
+// are.
+type KeySchema struct {
+	HashKey       string // name of the hash key attribute, PartitionKey if empty
+	HashTemplate  string // value of the hash key, {PartitionKey} if empty
+	RangeKey      string // name of the range key attribute, RowKey if empty
+	RangeTemplate string // value of the range key, {RowKey} if empty
+	Prefix        string // prepended to every hash key value, i.e. to share a table with other item types
+	HashOnly      bool   // the table has no range key, HashTemplate has to make keys unique, i.e. {PartitionKey}#{RowKey}
+	KeepKeys      bool   // also write PartitionKey and RowKey as plain attributes when they aren't key attributes
+}
+
+func valueOr(value string, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+func (schema KeySchema) hashKey() string {
+	return valueOr(schema.HashKey, "PartitionKey")
+}
+
+func (schema KeySchema) rangeKey() string {
+	return valueOr(schema.RangeKey, "RowKey")
+}
+
+// KeyNames returns the names of the key attributes, hash key first
+func (schema KeySchema) KeyNames() []string {
+	if schema.HashOnly {
+		return []string{schema.hashKey()}
+	}
+	return []string{schema.hashKey(), schema.rangeKey()}
+}
+
+// Validate checks that templates only refer to known placeholders, that together they refer to both so every
+// entity gets a key of its own, and that key attributes have distinct names
+func (schema KeySchema) Validate() error {
+	for _, template := range []string{schema.HashTemplate, schema.RangeTemplate} {
+		rest := strings.NewReplacer("{PartitionKey}", "", "{RowKey}", "").Replace(template)
+		if strings.ContainsAny(rest, "{}") {
+			return fmt.Errorf("key template %q may only refer to {PartitionKey} and {RowKey}", template)
+		}
+	}
+
+	templates := valueOr(schema.HashTemplate, "{PartitionKey}")
+	if !schema.HashOnly {
+		templates += valueOr(schema.RangeTemplate, "{RowKey}")
+	}
+	for _, placeholder := range []string{"{PartitionKey}", "{RowKey}"} {
+		if !strings.Contains(templates, placeholder) {
+			return fmt.Errorf("key templates don't refer to %v, entities that only differ in it would get the same key", placeholder)
+		}
+	}
+
+	if !schema.HashOnly && schema.hashKey() == schema.rangeKey() {
+		return fmt.Errorf("hash and range key are both named %q", schema.hashKey())
+	}
+	return nil
+}
+
+// Key returns the key attributes of the item entity is migrated to
+func (schema KeySchema) Key(entity *storage.Entity) map[string]*dynamodb.AttributeValue {
+	placeholders := keyPlaceholders(entity)
+	hash := schema.Prefix + placeholders.Replace(valueOr(schema.HashTemplate, "{PartitionKey}"))
+	key := map[string]*dynamodb.AttributeValue{
+		schema.hashKey(): {S: aws.String(hash)},
+	}
+
+	if !schema.HashOnly {
+		key[schema.rangeKey()] = &dynamodb.AttributeValue{S: aws.String(placeholders.Replace(valueOr(schema.RangeTemplate, "{RowKey}")))}
+	}
+	return key
+}
+
+// Item returns the key attributes of the item entity is migrated to, along with PartitionKey and RowKey if they
+// are kept
+func (schema KeySchema) Item(entity *storage.Entity) map[string]*dynamodb.AttributeValue {
+	item := schema.Key(entity)
+
+	if schema.KeepKeys {
+		for name, value := range map[string]string{"PartitionKey": entity.PartitionKey, "RowKey": entity.RowKey} {
+			if _, isKey := item[name]; !isKey {
+				item[name] = &dynamodb.AttributeValue{S: aws.String(value)}
+			}
+		}
+	}
+	return item
+}
@@ -0,0 +1,338 @@
+package dataprovider
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// LargeItemStrategy is what happens to items too big for dynamo
+type LargeItemStrategy string
+
+const (
+	// LargeFail counts the entity as failed without sending the item to dynamo
+	LargeFail LargeItemStrategy = "fail"
+	// LargeCompress gzips string and binary attributes into B
+	LargeCompress LargeItemStrategy = "compress"
+	// LargeChunk writes the item in chunks next to a manifest item under its key
+	LargeChunk LargeItemStrategy = "chunk"
+	// LargeOffload writes the item to a blob store and a pointer to it under its key
+	LargeOffload LargeItemStrategy = "offload"
+	// LargeReject writes the item to the rejects file instead of dynamo
+	LargeReject LargeItemStrategy = "reject"
+)
+
+const defaultChunkSize = 350 * 1024
+
+// LargeItemPolicy configures how items bigger than dynamo accepts are handled
+type LargeItemPolicy struct {
+	Strategy        string   // fail, compress, chunk, offload or reject, fail if empty
+	MaxSize         int      // items estimated bigger than this many bytes are handled, dynamo's 400KB if 0
+	CompressColumns []string // attributes compress gzips, every string and binary attribute but the keys if empty
+	ChunkSize       int      // bytes of the item every chunk holds, 350KB if 0
+	BlobDir         string   // directory offload writes items to
+	BlobBucket      string   // S3 bucket offload writes items to instead of BlobDir
+	BlobEndpoint    string   // endpoint of an S3 compatible store, i.e. http://localhost:9000, AWS if empty
+	BlobRegion      string   `default:"us-west-2"`
+	BlobPrefix      string   // prepended to the name of every blob
+	RejectsFile     string   // JSON lines file reject appends items to, rejects.jsonl if empty
+}
+
+// Validate checks that the strategy is known and has what it needs
+func (policy LargeItemPolicy) Validate() error {
+	switch LargeItemStrategy(strings.ToLower(policy.Strategy)) {
+	case "", LargeFail, LargeCompress, LargeChunk, LargeReject:
+	case LargeOffload:
+		if policy.BlobDir == "" && policy.BlobBucket == "" {
+			return fmt.Errorf("large items can only be offloaded with LARGEITEMS_BLOBDIR or LARGEITEMS_BLOBBUCKET")
+		}
+	default:
+		return fmt.Errorf("unknown large item strategy %q, use fail, compress, chunk, offload or reject", policy.Strategy)
+	}
+
+	if policy.ChunkSize < 0 || policy.ChunkSize > maxItemSize-1024 {
+		return fmt.Errorf("chunks of %v bytes don't fit into items", policy.ChunkSize)
+	}
+	return nil
+}
+
+// LargeItems handles items too big for dynamo according to its policy. The nil value fails them.
+type LargeItems struct {
+	policy   LargeItemPolicy
+	strategy LargeItemStrategy
+	keyNames []string
+	blobs    BlobStore
+	rejects  *RejectsFile
+
+	mutex   sync.Mutex
+	handled map[LargeItemStrategy]int
+}
+
+// NewLargeItems returns a handler for items too big for dynamo. keyNames are the key attributes of the table, hash
+// key first, blobs is only used to offload and rejects to reject items.
+func NewLargeItems(policy LargeItemPolicy, keyNames []string, blobs BlobStore, rejects *RejectsFile) *LargeItems {
+	strategy := LargeItemStrategy(strings.ToLower(policy.Strategy))
+	if strategy == "" {
+		strategy = LargeFail
+	}
+
+	return &LargeItems{
+		policy:   policy,
+		strategy: strategy,
+		keyNames: keyNames,
+		blobs:    blobs,
+		rejects:  rejects,
+		handled:  map[LargeItemStrategy]int{},
+	}
+}
+
+func (large *LargeItems) maxSize() int {
+	if large == nil || large.policy.MaxSize <= 0 {
+		return maxItemSize
+	}
+	return large.policy.MaxSize
+}
+
+// Handled returns how many items every strategy handled
+func (large *LargeItems) Handled() map[LargeItemStrategy]int {
+	handled := map[LargeItemStrategy]int{}
+	if large == nil {
+		return handled
+	}
+
+	large.mutex.Lock()
+	defer large.mutex.Unlock()
+	for strategy, count := range large.handled {
+		handled[strategy] = count
+	}
+	return handled
+}
+
+// items returns the items written for item, which is item itself unless it is too big. Items that are rejected
+// return none, items that can't be handled an error.
+func (large *LargeItems) items(item map[string]*dynamodb.AttributeValue) ([]map[string]*dynamodb.AttributeValue, error) {
+	size := ItemSize(item)
+	if size <= large.maxSize() {
+		return []map[string]*dynamodb.AttributeValue{item}, nil
+	}
+
+	strategy := LargeFail
+	if large != nil {
+		strategy = large.strategy
+	}
+
+	var items []map[string]*dynamodb.AttributeValue
+	var err error
+	switch strategy {
+	case LargeCompress:
+		items, err = large.compress(item)
+	case LargeChunk:
+		items, err = large.chunk(item)
+	case LargeOffload:
+		items, err = large.offload(item, size)
+	case LargeReject:
+		err = large.rejects.Write(item, size)
+	default:
+		err = fmt.Errorf("item of %v bytes is bigger than the %v bytes dynamo accepts", size, large.maxSize())
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	large.mutex.Lock()
+	large.handled[strategy]++
+	large.mutex.Unlock()
+	return items, nil
+}
+
+func (large *LargeItems) isKey(name string) bool {
+	for _, key := range large.keyNames {
+		if name == key {
+			return true
+		}
+	}
+	return false
+}
+
+// key returns the key attributes of item
+func (large *LargeItems) key(item map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+	key := make(map[string]*dynamodb.AttributeValue, len(large.keyNames))
+	for _, name := range large.keyNames {
+		key[name] = item[name]
+	}
+	return key
+}
+
+// compress gzips the configured attributes and lists them in the Compressed attribute
+func (large *LargeItems) compress(item map[string]*dynamodb.AttributeValue) ([]map[string]*dynamodb.AttributeValue, error) {
+	compressed := make(map[string]*dynamodb.AttributeValue, len(item)+1)
+	names := []*string{}
+
+	for name, value := range item {
+		compressed[name] = value
+
+		selected := !large.isKey(name)
+		if len(large.policy.CompressColumns) > 0 {
+			selected = selected && matchesAny(large.policy.CompressColumns, name)
+		}
+
+		var raw []byte
+		switch {
+		case !selected:
+			continue
+		case value.S != nil:
+			raw = []byte(*value.S)
+		case value.B != nil:
+			raw = value.B
+		default:
+			continue
+		}
+
+		zipped, err := gzipBytes(raw)
+		if err != nil {
+			return nil, err
+		}
+		compressed[name] = &dynamodb.AttributeValue{B: zipped}
+		names = append(names, aws.String(name))
+	}
+
+	if len(names) > 0 {
+		sort.Slice(names, func(i, j int) bool { return *names[i] < *names[j] })
+		compressed["Compressed"] = &dynamodb.AttributeValue{SS: names}
+	}
+
+	if size := ItemSize(compressed); size > large.maxSize() {
+		return nil, fmt.Errorf("item is still %v bytes once compressed, more than the %v bytes dynamo accepts", size, large.maxSize())
+	}
+	return []map[string]*dynamodb.AttributeValue{compressed}, nil
+}
+
+func gzipBytes(raw []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	if _, err := writer.Write(raw); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// attributeJSON returns value as it is written in DynamoDB JSON, i.e. {"S": "a"} or {"M": {"n": {"N": "1"}}}
+func attributeJSON(value *dynamodb.AttributeValue) map[string]interface{} {
+	switch {
+	case value.B != nil:
+		return map[string]interface{}{"B": value.B}
+	case value.BOOL != nil:
+		return map[string]interface{}{"BOOL": *value.BOOL}
+	case value.BS != nil:
+		return map[string]interface{}{"BS": value.BS}
+	case value.L != nil:
+		list := make([]interface{}, len(value.L))
+		for i, element := range value.L {
+			list[i] = attributeJSON(element)
+		}
+		return map[string]interface{}{"L": list}
+	case value.M != nil:
+		return map[string]interface{}{"M": attributesJSON(value.M)}
+	case value.N != nil:
+		return map[string]interface{}{"N": *value.N}
+	case value.NS != nil:
+		return map[string]interface{}{"NS": aws.StringValueSlice(value.NS)}
+	case value.NULL != nil:
+		return map[string]interface{}{"NULL": *value.NULL}
+	case value.S != nil:
+		return map[string]interface{}{"S": *value.S}
+	case value.SS != nil:
+		return map[string]interface{}{"SS": aws.StringValueSlice(value.SS)}
+	}
+	return map[string]interface{}{}
+}
+
+func attributesJSON(attributes map[string]*dynamodb.AttributeValue) map[string]interface{} {
+	converted := make(map[string]interface{}, len(attributes))
+	for name, value := range attributes {
+		converted[name] = attributeJSON(value)
+	}
+	return converted
+}
+
+// itemJSON writes item in DynamoDB JSON, the format the AWS CLI and data pipelines read items in
+func itemJSON(item map[string]*dynamodb.AttributeValue) ([]byte, error) {
+	return json.Marshal(attributesJSON(item))
+}
+
+// chunk writes the attributes other than the keys as DynamoDB JSON in chunks. Chunk n is keyed on the item's keys
+// with #chunk-n appended to the range key, or to the hash key of tables without one. The manifest under the item's
+// own key counts the chunks.
+func (large *LargeItems) chunk(item map[string]*dynamodb.AttributeValue) ([]map[string]*dynamodb.AttributeValue, error) {
+	attributes := map[string]*dynamodb.AttributeValue{}
+	for name, value := range item {
+		if !large.isKey(name) {
+			attributes[name] = value
+		}
+	}
+
+	payload, err := itemJSON(attributes)
+	if err != nil {
+		return nil, err
+	}
+
+	chunkSize := large.policy.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	}
+
+	items := []map[string]*dynamodb.AttributeValue{}
+	chunkKey := large.keyNames[len(large.keyNames)-1]
+	for start, n := 0, 1; start < len(payload); start, n = start+chunkSize, n+1 {
+		end := start + chunkSize
+		if end > len(payload) {
+			end = len(payload)
+		}
+
+		chunk := large.key(item)
+		chunk[chunkKey] = &dynamodb.AttributeValue{S: aws.String(fmt.Sprintf("%v#chunk-%v", *item[chunkKey].S, n))}
+		chunk["Chunk"] = numberAttribute(strconv.Itoa(n))
+		chunk["Data"] = &dynamodb.AttributeValue{B: payload[start:end]}
+		items = append(items, chunk)
+	}
+
+	manifest := large.key(item)
+	manifest["Chunks"] = numberAttribute(strconv.Itoa(len(items)))
+	manifest["ChunkedSize"] = numberAttribute(strconv.Itoa(len(payload)))
+	return append(items, manifest), nil
+}
+
+// offload writes the whole item as DynamoDB JSON to the blob store and returns an item that points to it
+func (large *LargeItems) offload(item map[string]*dynamodb.AttributeValue, size int) ([]map[string]*dynamodb.AttributeValue, error) {
+	payload, err := itemJSON(item)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := make([]string, len(large.keyNames))
+	for i, name := range large.keyNames {
+		parts[i] = *item[name].S
+	}
+
+	location, err := large.blobs.PutBlob(large.policy.BlobPrefix+blobName(parts)+".json", payload)
+	if err != nil {
+		return nil, fmt.Errorf("could not offload item: %v", err)
+	}
+
+	pointer := large.key(item)
+	pointer["Offloaded"] = &dynamodb.AttributeValue{S: aws.String(location)}
+	pointer["OffloadedSize"] = numberAttribute(strconv.Itoa(size))
+	return []map[string]*dynamodb.AttributeValue{pointer}, nil
+}
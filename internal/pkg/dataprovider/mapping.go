@@ -0,0 +1,108 @@
+package dataprovider
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// Mapping describes how entities are converted to dynamo items
+type Mapping struct {
+	Keys        KeySchema
+	ColumnNames []string // properties other than partition key, row key and timestamp that are migrated
+	Columns     ColumnSelection
+	Types       map[string]AttributeType // overrides the attribute type of columns
+	Strict      bool                     // fail entities with values that can't be converted instead of skipping the value
+	Empty       EmptyValues              // what empty strings and nulls are migrated to, omitted by default
+	Transforms  Pipeline                 // applied to every item once it is mapped
+	InvalidJSON JSONFallback             // what happens to values of JSON typed columns that can't be decoded, kept by default
+	LargeItems  *LargeItems              // handles items too big for dynamo, they fail if nil
+	TimeFormats TimeFormats              // how times are written, the entity's Timestamp included
+	Timestamp   string                   // attribute the entity's Timestamp is written to, Timestamp if empty
+	NoTimestamp bool                     // don't write the entity's Timestamp at all
+	TTL         *TTL                     // derives the expiry of items, none if nil
+	Unmapped    *ColumnReport            // collects properties that are not migrated, if set
+	Skipped     *ColumnReport            // collects properties whose values could not be converted, if set
+}
+
+func storageEntityToDynamoKey(entity *storage.Entity, mapping *Mapping) map[string]*dynamodb.AttributeValue {
+	return mapping.Keys.Key(entity)
+}
+
+// storageEntityToDynamoMap converts entity to the item it is migrated to, nil if it is skipped because it expired
+func storageEntityToDynamoMap(entity *storage.Entity, mapping *Mapping) (map[string]*dynamodb.AttributeValue, error) {
+	expiryName, expiry, write, err := mapping.TTL.expiry(entity)
+	if err != nil {
+		if mapping.Strict {
+			return nil, err
+		}
+		mapping.Skipped.add([]string{mapping.TTL.policy.From})
+	} else if !write {
+		return nil, nil
+	}
+
+	dynamoMap := map[string]*dynamodb.AttributeValue{}
+	if !mapping.NoTimestamp {
+		dynamoMap[valueOr(mapping.Timestamp, "Timestamp")] = mapping.TimeFormats.attribute("Timestamp", entity.TimeStamp)
+	}
+
+	for _, key := range mapping.columns(entity) {
+		// a column the entity doesn't have is null
+		attribute, err := mapping.attribute(key, entity.Properties[key])
+		if err != nil {
+			if mapping.Strict || mapping.Types[key].isJSON() && mapping.InvalidJSON == JSONFail {
+				return nil, fmt.Errorf("column %v: %v", key, err)
+			}
+			mapping.Skipped.add([]string{key})
+			continue
+		}
+
+		if attribute != nil {
+			dynamoMap[key] = attribute
+		}
+	}
+
+	if expiry != nil {
+		dynamoMap[expiryName] = expiry
+	}
+
+	// key attributes win over columns of the same name
+	for name, value := range mapping.Keys.Item(entity) {
+		dynamoMap[name] = value
+	}
+
+	if err := mapping.Transforms.Apply(dynamoMap); err != nil {
+		return nil, err
+	}
+
+	return dynamoMap, nil
+}
+
+// attribute converts value of column to its attribute, nil if it is omitted
+func (mapping *Mapping) attribute(column string, value interface{}) (*dynamodb.AttributeValue, error) {
+	if policy, empty := mapping.Empty.policy(column, value); empty {
+		return policy.attribute(mapping.Types[column])
+	}
+
+	if t, ok := value.(time.Time); ok {
+		attribute := mapping.TimeFormats.attribute(column, t)
+		if mapping.Types[column] == "" {
+			return attribute, nil
+		}
+		return convertAttribute(attribute, mapping.Types[column])
+	}
+
+	attribute, err := columnAttribute(value, mapping.Types[column])
+	if err != nil && mapping.Types[column].isJSON() {
+		switch mapping.InvalidJSON {
+		case "", JSONKeep:
+			return columnAttribute(value, "")
+		case JSONNull:
+			return &dynamodb.AttributeValue{NULL: aws.Bool(true)}, nil
+		}
+	}
+	return attribute, err
+}
@@ -0,0 +1,210 @@
+package dataprovider
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// KeySampler is implemented by sources that can list partition keys without reading whole entities, which lets
+// ranges be planned from samples of the key space.
+type KeySampler interface {
+	// SampleKeys returns the partition keys of the first limit entities inside queryRange in key order.
+	SampleKeys(queryRange QueryRange, limit int) ([]string, error)
+}
+
+// samplesPerRange is how many evenly spaced parts of every grid range are sampled, so keys bunched up inside a grid
+// range don't make its first keys stand in for all of it
+const samplesPerRange = 4
+
+// PlanSpec describes how to plan ranges from samples. The ranges of RangeSpec form the sampling grid, every grid
+// range is sampled in evenly spaced parts that share SampleSize and split or merged with its neighbours so each
+// planned range holds about TargetItems.
+type PlanSpec struct {
+	RangeSpec
+	TargetItems int
+	SampleSize  int
+}
+
+// keySpace maps partition keys to positions in [0, 1] and back, treating keys as fractions in the base of the
+// alphabet so that positions sort the same way keys do
+type keySpace struct {
+	alphabet []string
+}
+
+func (space keySpace) base() float64 {
+	return float64(len(space.alphabet))
+}
+
+// position returns where key lies in the key space. A character outside the alphabet ends the key at the boundary
+// of the alphabet characters around it, i.e. "g" is the end of lowercase hex keys.
+func (space keySpace) position(key string) float64 {
+	position := 0.0
+	scale := 1.0
+
+	for _, char := range key {
+		scale /= space.base()
+		digit := sort.SearchStrings(space.alphabet, string(char))
+		position += float64(digit) * scale
+
+		if digit == len(space.alphabet) || space.alphabet[digit] != string(char) {
+			break
+		}
+	}
+	return position
+}
+
+// key returns the key of the given length at position
+func (space keySpace) key(position float64, length int) string {
+	key := ""
+	for i := 0; i < length; i++ {
+		position *= space.base()
+		digit := int(math.Floor(position))
+		if digit >= len(space.alphabet) {
+			digit = len(space.alphabet) - 1
+		}
+		if digit < 0 {
+			digit = 0
+		}
+		position -= float64(digit)
+		key += space.alphabet[digit]
+	}
+	return key
+}
+
+// split divides queryRange into up to parts ranges of equal width in the key space. Split points that don't fall
+// strictly between the bounds of queryRange are dropped, so fewer ranges may come back.
+func (space keySpace) split(queryRange QueryRange, parts int) []QueryRange {
+	ge := space.position(queryRange.Ge)
+	width := space.position(queryRange.Lt) - ge
+	length := len(queryRange.Ge)
+	if len(queryRange.Lt) > length {
+		length = len(queryRange.Lt)
+	}
+	length += int(math.Ceil(math.Log(float64(parts))/math.Log(space.base()))) + 1
+
+	ranges := []QueryRange{}
+	lower := queryRange.Ge
+	for i := 1; i < parts; i++ {
+		bound := space.key(ge+width*float64(i)/float64(parts), length)
+		if bound > lower && bound < queryRange.Lt {
+			ranges = append(ranges, NewQueryRange(lower, bound))
+			lower = bound
+		}
+	}
+	return append(ranges, NewQueryRange(lower, queryRange.Lt))
+}
+
+// estimateItems estimates how many items queryRange holds from a full sample of the first keys in it, assuming
+// the rest of the range is as dense as the sampled part
+func (space keySpace) estimateItems(queryRange QueryRange, keys []string) float64 {
+	ge := space.position(queryRange.Ge)
+	sampled := space.position(keys[len(keys)-1]) - ge
+	if sampled <= 0 {
+		// a single partition key fills the sample, nothing is known about the rest of the range
+		return float64(len(keys))
+	}
+	return float64(len(keys)) * (space.position(queryRange.Lt) - ge) / sampled
+}
+
+// SplitRange divides queryRange into up to parts ranges of equal width in the key space of alphabet, lowercase hex
+// if no alphabet is given
+func SplitRange(queryRange QueryRange, parts int, alphabet []string) []QueryRange {
+	if len(alphabet) == 0 {
+		alphabet = hexLowerAlphabet
+	}
+	return keySpace{alphabet: alphabet}.split(queryRange, parts)
+}
+
+type plannedPiece struct {
+	QueryRange
+	items float64
+}
+
+// PlanRanges samples every range of the grid described by spec and returns consecutive ranges covering the same
+// key space that each hold about spec.TargetItems items by estimate.
+func PlanRanges(sampler KeySampler, spec PlanSpec) ([]QueryRange, error) {
+	if spec.TargetItems < 1 || spec.SampleSize < 1 {
+		return nil, fmt.Errorf("target items and sample size must be positive, got %v and %v", spec.TargetItems, spec.SampleSize)
+	}
+
+	grid, err := GenerateRanges(spec.RangeSpec)
+	if err != nil || len(grid) == 0 {
+		return grid, err
+	}
+
+	space := keySpace{alphabet: spec.Alphabet}
+	if len(space.alphabet) == 0 {
+		space.alphabet = hexLowerAlphabet
+	}
+
+	sampleSize := int(math.Ceil(float64(spec.SampleSize) / samplesPerRange))
+	pieces := []plannedPiece{}
+	for _, gridRange := range grid {
+		for _, sampledRange := range space.split(gridRange, samplesPerRange) {
+			sampled, err := samplePieces(sampler, space, sampledRange, sampleSize, spec.TargetItems)
+			if err != nil {
+				return nil, err
+			}
+			pieces = append(pieces, sampled...)
+		}
+	}
+
+	return mergePieces(pieces, float64(spec.TargetItems)), nil
+}
+
+// samplePieces samples up to sampleSize keys of queryRange and splits it into pieces of about targetItems
+func samplePieces(sampler KeySampler, space keySpace, queryRange QueryRange, sampleSize int, targetItems int) ([]plannedPiece, error) {
+	keys, err := sampler.SampleKeys(queryRange, sampleSize)
+	if err != nil {
+		return nil, fmt.Errorf("could not sample range ge: %v and lt: %v: %v", queryRange.Ge, queryRange.Lt, err)
+	}
+
+	if len(keys) < sampleSize {
+		return keyPieces(queryRange, keys), nil
+	}
+
+	items := space.estimateItems(queryRange, keys)
+	parts := int(math.Ceil(items / float64(targetItems)))
+
+	split := space.split(queryRange, parts)
+	pieces := make([]plannedPiece, len(split))
+	for i, splitRange := range split {
+		pieces[i] = plannedPiece{splitRange, items / float64(len(split))}
+	}
+	return pieces, nil
+}
+
+// keyPieces splits a range that was sampled in full at every partition key in it, so the pieces hold exact counts
+func keyPieces(queryRange QueryRange, keys []string) []plannedPiece {
+	pieces := []plannedPiece{}
+	lower := queryRange.Ge
+	items := 0.0
+
+	for i, key := range keys {
+		if i > 0 && key != keys[i-1] {
+			pieces = append(pieces, plannedPiece{NewQueryRange(lower, key), items})
+			lower = key
+			items = 0
+		}
+		items++
+	}
+	return append(pieces, plannedPiece{NewQueryRange(lower, queryRange.Lt), items})
+}
+
+// mergePieces joins consecutive pieces as long as they stay within target items
+func mergePieces(pieces []plannedPiece, target float64) []QueryRange {
+	ranges := []QueryRange{}
+	lower := pieces[0].Ge
+	items := 0.0
+
+	for _, piece := range pieces {
+		if items > 0 && items+piece.items > target {
+			ranges = append(ranges, NewQueryRange(lower, piece.Ge))
+			lower = piece.Ge
+			items = 0
+		}
+		items += piece.items
+	}
+	return append(ranges, NewQueryRange(lower, pieces[len(pieces)-1].Lt))
+}
@@ -0,0 +1,113 @@
+package dataprovider_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	dp "github.com/ImagineLearning/tablestorage-to-dynamo/internal/pkg/dataprovider"
+	"github.com/ImagineLearning/tablestorage-to-dynamo/internal/pkg/dataprovider/dptest"
+)
+
+func countEntities(t *testing.T, source *dptest.MemorySource, queryRange dp.QueryRange) int {
+	entities, err := source.ReadRange(queryRange)
+	if err != nil {
+		t.Fatalf("Could not read range %v: %v", queryRange, err)
+	}
+	return len(entities)
+}
+
+func TestPlanRangesBalancesSkewedKeys(t *testing.T) {
+	source := dptest.NewMemorySource()
+	for i := 0; i < 2000; i++ {
+		source.Add(&storage.Entity{PartitionKey: fmt.Sprintf("0%03x", i), RowKey: "a"})
+	}
+	for i := 1; i <= 200; i++ {
+		source.Add(&storage.Entity{PartitionKey: fmt.Sprintf("%04x", i*300), RowKey: "a"})
+	}
+
+	spec := dp.PlanSpec{
+		RangeSpec:   dp.RangeSpec{Prefixes: strings.Split("0,1,2,3,4,5,6,7,8,9,a,b,c,d,e,f,g", ","), Precision: 1},
+		TargetItems: 250,
+		SampleSize:  100,
+	}
+	ranges, err := dp.PlanRanges(source, spec)
+
+	if err != nil {
+		t.Fatalf("Could not plan ranges: %v", err)
+	}
+
+	if ranges[0].Ge != "0" || ranges[len(ranges)-1].Lt != "g" {
+		t.Errorf("Planned ranges do not span 0 to g: %v", ranges)
+	}
+
+	total := 0
+	for i, queryRange := range ranges {
+		if i > 0 && queryRange.Ge != ranges[i-1].Lt {
+			t.Errorf("Gap between ranges %v and %v", ranges[i-1], queryRange)
+		}
+
+		items := countEntities(t, source, queryRange)
+		if items > 2*spec.TargetItems {
+			t.Errorf("Range %v holds %v items, expected about %v", queryRange, items, spec.TargetItems)
+		}
+		total += items
+	}
+
+	if total != 2200 {
+		t.Errorf("Expected planned ranges to cover 2200 items, got %v", total)
+	}
+
+	if len(ranges) < 9 || len(ranges) > 30 {
+		t.Errorf("Expected around 9 ranges, got %v: %v", len(ranges), ranges)
+	}
+}
+
+func TestPlanRangesSamplesAcrossGridRanges(t *testing.T) {
+	source := dptest.NewMemorySource()
+	for i := 0; i < 12; i++ {
+		source.Add(&storage.Entity{PartitionKey: fmt.Sprintf("0%x0", i), RowKey: "a"})
+	}
+	for i := 0; i < 2000; i++ {
+		source.Add(&storage.Entity{PartitionKey: fmt.Sprintf("0c%03x", i), RowKey: "a"})
+	}
+
+	spec := dp.PlanSpec{RangeSpec: dp.RangeSpec{Prefixes: []string{"0", "1"}, Precision: 1}, TargetItems: 250, SampleSize: 100}
+	ranges, err := dp.PlanRanges(source, spec)
+
+	if err != nil {
+		t.Fatalf("Could not plan ranges: %v", err)
+	}
+
+	total := 0
+	for _, queryRange := range ranges {
+		items := countEntities(t, source, queryRange)
+		if items > 2*spec.TargetItems {
+			t.Errorf("Range %v holds %v items, expected about %v", queryRange, items, spec.TargetItems)
+		}
+		total += items
+	}
+
+	if total != 2012 {
+		t.Errorf("Expected planned ranges to cover 2012 items, got %v", total)
+	}
+}
+
+func TestPlanRangesSplitsFullySampledRangesAtKeys(t *testing.T) {
+	source := dptest.NewMemorySource()
+	for _, key := range []string{"01", "01", "02", "05", "05", "05", "07", "0a", "0b", "0c"} {
+		source.Add(&storage.Entity{PartitionKey: key, RowKey: "a"})
+	}
+
+	ranges, err := dp.PlanRanges(source, dp.PlanSpec{RangeSpec: dp.RangeSpec{Prefixes: []string{"0", "1"}, Precision: 1}, TargetItems: 3, SampleSize: 100})
+
+	if err != nil {
+		t.Fatalf("Could not plan ranges: %v", err)
+	}
+
+	expected := []dp.QueryRange{dp.NewQueryRange("0", "040"), dp.NewQueryRange("040", "07"), dp.NewQueryRange("07", "0c"), dp.NewQueryRange("0c", "1")}
+	if fmt.Sprint(ranges) != fmt.Sprint(expected) {
+		t.Errorf("Expected ranges %v, got %v", expected, ranges)
+	}
+}
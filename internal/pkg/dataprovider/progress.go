@@ -0,0 +1,168 @@
+package dataprovider
+
+import (
+	"fmt"
+	"log"
+	"sync"
+)
+
+// pageProgress is a batch queued for writing and where reading resumes once it has been written
+type pageProgress struct {
+	resume  Continuation
+	written bool
+	ok      bool
+}
+
+// rangeProgress collects the outcome of the batches a range is written in. The range is checkpointed every time the
+// batches written so far, in the order they were read, have all been written successfully, and recorded once it has
+// been read completely and every batch queued for it has been written.
+type rangeProgress struct {
+	mutex    sync.Mutex
+	record   RangeRecord
+	reading  bool
+	pending  int
+	failed   int
+	readErr  error
+	writeErr error
+
+	pages   []*pageProgress // pages queued but not checkpointed yet, in the order they were read
+	stalled bool            // a page could not be written in full, the checkpoint stays before it
+
+	status   StatusStore // nil if ranges aren't recorded, i.e. when undoing a migration
+	failures *FailedRanges
+	wg       *sync.WaitGroup
+}
+
+func newRangeProgress(record RangeRecord, status StatusStore, failures *FailedRanges, wg *sync.WaitGroup) *rangeProgress {
+	return &rangeProgress{
+		record:   record,
+		reading:  true,
+		status:   status,
+		failures: failures,
+		wg:       wg,
+	}
+}
+
+// queryRange returns the range the progress is recorded for
+func (progress *rangeProgress) queryRange() QueryRange {
+	progress.mutex.Lock()
+	defer progress.mutex.Unlock()
+
+	return progress.record.QueryRange
+}
+
+// queued counts a batch of items on its way to the write workers, reading resumes at resume once it has been
+// written. The returned page is handed back to written.
+func (progress *rangeProgress) queued(items int, resume Continuation) *pageProgress {
+	progress.mutex.Lock()
+	defer progress.mutex.Unlock()
+
+	page := &pageProgress{resume: resume}
+	progress.pages = append(progress.pages, page)
+	progress.pending++
+	progress.record.ItemsRead += items
+	return page
+}
+
+// written counts page as written, failed of its items could not be written and rejected were left out on purpose
+func (progress *rangeProgress) written(page *pageProgress, items int, failed int, rejected int, bytes int, err error) {
+	progress.mutex.Lock()
+	defer progress.mutex.Unlock()
+
+	page.written = true
+	page.ok = failed == 0 && err == nil
+	progress.pending--
+	progress.record.ItemsWritten += items - failed - rejected
+	progress.record.ItemsRejected += rejected
+	progress.record.Bytes += bytes
+	progress.failed += failed
+	if err != nil {
+		progress.writeErr = err
+	}
+	progress.checkpoint()
+	progress.finishIfDone()
+}
+
+// checkpoint moves the checkpoint past the pages at the front that have been written successfully and stores it
+// if it moved. A page that was read last has nowhere to resume, the range is recorded right after it anyway.
+func (progress *rangeProgress) checkpoint() {
+	moved := false
+	for !progress.stalled && len(progress.pages) > 0 && progress.pages[0].written {
+		page := progress.pages[0]
+		progress.pages = progress.pages[1:]
+
+		if !page.ok {
+			progress.stalled = true
+		} else if !page.resume.IsZero() {
+			resume := page.resume
+			progress.record.Checkpoint = &resume
+			moved = true
+		}
+	}
+
+	if !moved || progress.status == nil {
+		return
+	}
+
+	err := progress.status.CheckpointRange(progress.record)
+	if err != nil {
+		log.Printf("Could not checkpoint range ge: %v and lt: %v: %v", progress.record.Ge, progress.record.Lt, err)
+	}
+}
+
+// narrow moves the progress to record, used when the range being read is split and what has been read so far
+// belongs to its first child
+func (progress *rangeProgress) narrow(record RangeRecord) {
+	progress.mutex.Lock()
+	defer progress.mutex.Unlock()
+
+	record.ItemsRead = progress.record.ItemsRead
+	record.ItemsWritten = progress.record.ItemsWritten
+	record.ItemsRejected = progress.record.ItemsRejected
+	record.Bytes = progress.record.Bytes
+	record.Checkpoint = progress.record.Checkpoint
+	progress.record = record
+}
+
+// doneReading marks the range as read, err is the error reading was given up on if any
+func (progress *rangeProgress) doneReading(err error) {
+	progress.mutex.Lock()
+	defer progress.mutex.Unlock()
+
+	progress.reading = false
+	progress.readErr = err
+	progress.finishIfDone()
+}
+
+func (progress *rangeProgress) finishIfDone() {
+	if progress.reading || progress.pending > 0 {
+		return
+	}
+
+	outcome := writeOutcome(progress.record.ItemsRead, progress.failed, progress.writeErr)
+	err := progress.writeErr
+	rejectedOnly := outcome == RangeCompleted && progress.record.ItemsRejected > 0
+	if progress.readErr != nil {
+		outcome = RangeFailed
+		err = progress.readErr
+	} else if rejectedOnly {
+		// the next attempt reads the whole range again and rejects the same entities, its count starts over
+		outcome = RangePartial
+		err = fmt.Errorf("%v entities were rejected as too big for dynamo", progress.record.ItemsRejected)
+	} else if outcome != RangeCompleted && err == nil {
+		err = fmt.Errorf("%v entities could not be written", progress.failed)
+	}
+
+	if outcome == RangeCompleted || rejectedOnly {
+		progress.record.Checkpoint = nil
+	}
+	if outcome != RangeCompleted {
+		progress.failures.Add(progress.record.QueryRange, err)
+	}
+
+	progress.record.Finish(outcome, err)
+	if progress.status != nil {
+		progress.status.WriteRangeRecord(progress.record)
+	}
+	progress.wg.Done()
+}
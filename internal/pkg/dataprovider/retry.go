@@ -0,0 +1,75 @@
+package dataprovider
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// RetryPolicy configures how often and how patiently failed calls are retried
+type RetryPolicy struct {
+	MaxAttempts int           `default:"5"`
+	BaseDelay   time.Duration `default:"1s"`
+	MaxDelay    time.Duration `default:"30s"`
+}
+
+// Attempts returns the number of attempts allowed by the policy, which is always at least one
+func (policy RetryPolicy) Attempts() int {
+	if policy.MaxAttempts < 1 {
+		return 1
+	}
+	return policy.MaxAttempts
+}
+
+// Backoff returns how long to wait after the given failed attempt (starting at 1). The delay doubles with
+// every attempt up to MaxDelay and is jittered between half and all of that value.
+func (policy RetryPolicy) Backoff(attempt int) time.Duration {
+	delay := policy.BaseDelay
+	for i := 1; i < attempt && delay < policy.MaxDelay; i++ {
+		delay *= 2
+	}
+
+	if policy.MaxDelay > 0 && delay > policy.MaxDelay {
+		delay = policy.MaxDelay
+	}
+
+	if delay <= 0 {
+		return 0
+	}
+
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
+// FailedRange is a query range that could not be migrated and the last error seen for it
+type FailedRange struct {
+	QueryRange
+	Err error
+}
+
+func (failedRange FailedRange) String() string {
+	return fmt.Sprintf("ge: %v and lt: %v: %v", failedRange.Ge, failedRange.Lt, failedRange.Err)
+}
+
+// FailedRanges collects the ranges workers gave up on. It is safe for concurrent use.
+type FailedRanges struct {
+	mutex  sync.Mutex
+	ranges []FailedRange
+}
+
+// Add records queryRange as failed with err
+func (failedRanges *FailedRanges) Add(queryRange QueryRange, err error) {
+	failedRanges.mutex.Lock()
+	defer failedRanges.mutex.Unlock()
+
+	failedRanges.ranges = append(failedRanges.ranges, FailedRange{QueryRange: queryRange, Err: err})
+}
+
+// Ranges returns every range recorded as failed
+func (failedRanges *FailedRanges) Ranges() []FailedRange {
+	failedRanges.mutex.Lock()
+	defer failedRanges.mutex.Unlock()
+
+	return append([]FailedRange{}, failedRanges.ranges...)
+}
@@ -0,0 +1,197 @@
+package dataprovider
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/satori/go.uuid"
+)
+
+// maxItemSize is the largest item dynamo accepts
+const maxItemSize = 400 * 1024
+
+// MappingFile is the column mapping a migration can be configured with from a JSON file, as SchemaReport writes it
+type MappingFile struct {
+	ColumnNames []string          `json:"columnNames"`
+	ColumnTypes map[string]string `json:"columnTypes,omitempty"`
+	Transforms  json.RawMessage   `json:"transforms,omitempty"` // parsed by ParsePipeline
+	TimeFormats map[string]string `json:"timeFormats,omitempty"`
+}
+
+// LoadMappingFile reads a mapping from the JSON file at path, fields other than the mapping are ignored so a schema
+// report can be used as it is
+func LoadMappingFile(path string) (MappingFile, error) {
+	mapping := MappingFile{}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return mapping, err
+	}
+
+	err = json.Unmarshal(contents, &mapping)
+	if err != nil {
+		return mapping, fmt.Errorf("could not parse mapping file %v: %v", path, err)
+	}
+	return mapping, nil
+}
+
+// ColumnSchema is what has been observed of a column
+type ColumnSchema struct {
+	Name      string         `json:"name"`
+	EdmTypes  map[string]int `json:"edmTypes"` // how many values of every Edm type were found
+	Entities  int            `json:"entities"` // how many entities had the column
+	Empty     int            `json:"empty"`    // how many of them held an empty string
+	JSON      int            `json:"json"`     // how many of them held a JSON object or array, which JSON column types decode
+	NullRate  float64        `json:"nullRate"` // share of entities read without the column, table storage doesn't store nulls
+	EmptyRate float64        `json:"emptyRate"`
+	MaxSize   int            `json:"maxSize"` // size of the largest value as dynamo accounts for it
+}
+
+// ItemSizes summarizes the estimated size of the items entities are migrated to
+type ItemSizes struct {
+	Average   float64 `json:"average"`
+	Max       int     `json:"max"`
+	OverLimit int     `json:"overLimit"` // items bigger than the 400KB dynamo accepts
+}
+
+// SchemaReport collects the columns and types of the entities added to it. Once finished its mapping lists every
+// column and converts columns that were found with values of different attribute types to strings.
+type SchemaReport struct {
+	MappingFile
+	Entities  int            `json:"entities"`
+	Columns   []ColumnSchema `json:"columns"`
+	ItemSizes ItemSizes      `json:"itemSizes"`
+
+	columns   map[string]*ColumnSchema
+	totalSize int
+	mapping   *Mapping
+}
+
+// NewSchemaReport returns an empty report
+func NewSchemaReport() *SchemaReport {
+	return &SchemaReport{
+		columns: map[string]*ColumnSchema{},
+		mapping: &Mapping{Columns: ColumnSelection{All: true}},
+	}
+}
+
+// edmTypeOf names the Edm type of a property value. Numbers without a type annotation are Edm.Int32 if they are
+// whole and fit, Edm.Double otherwise, as table storage doesn't tell them apart in JSON.
+func edmTypeOf(value interface{}) string {
+	switch value := value.(type) {
+	case string:
+		return "Edm.String"
+	case int32:
+		return "Edm.Int32"
+	case int, int64:
+		return "Edm.Int64"
+	case float64:
+		if value == math.Trunc(value) && value >= math.MinInt32 && value <= math.MaxInt32 {
+			return "Edm.Int32"
+		}
+		return "Edm.Double"
+	case bool:
+		return "Edm.Boolean"
+	case time.Time:
+		return "Edm.DateTime"
+	case uuid.UUID:
+		return "Edm.Guid"
+	case []byte:
+		return "Edm.Binary"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// Add records the columns of entity
+func (report *SchemaReport) Add(entity *storage.Entity) {
+	report.Entities++
+
+	for name, value := range entity.Properties {
+		column, found := report.columns[name]
+		if !found {
+			column = &ColumnSchema{Name: name, EdmTypes: map[string]int{}}
+			report.columns[name] = column
+		}
+
+		if value == nil {
+			continue
+		}
+
+		column.Entities++
+		column.EdmTypes[edmTypeOf(value)]++
+		if value == "" {
+			column.Empty++
+		}
+		if isJSONText(value) {
+			column.JSON++
+		}
+
+		if attribute, err := edmAttribute(value); err == nil {
+			if size := attributeValueSize(attribute); size > column.MaxSize {
+				column.MaxSize = size
+			}
+		}
+	}
+
+	item, err := storageEntityToDynamoMap(entity, report.mapping)
+	if err != nil {
+		return
+	}
+
+	size := ItemSize(item)
+	report.totalSize += size
+	if size > report.ItemSizes.Max {
+		report.ItemSizes.Max = size
+	}
+	if size > maxItemSize {
+		report.ItemSizes.OverLimit++
+	}
+}
+
+// Finish computes rates and averages and the mapping of the columns found
+func (report *SchemaReport) Finish() {
+	report.Columns = make([]ColumnSchema, 0, len(report.columns))
+	report.ColumnNames = make([]string, 0, len(report.columns))
+	report.ColumnTypes = map[string]string{}
+
+	for _, column := range report.columns {
+		if report.Entities > 0 {
+			column.NullRate = float64(report.Entities-column.Entities) / float64(report.Entities)
+			column.EmptyRate = float64(column.Empty) / float64(report.Entities)
+		}
+
+		report.Columns = append(report.Columns, *column)
+		report.ColumnNames = append(report.ColumnNames, column.Name)
+		if attributeTypes(column.EdmTypes) > 1 {
+			report.ColumnTypes[column.Name] = string(TypeString)
+		}
+	}
+
+	sort.Slice(report.Columns, func(i, j int) bool { return report.Columns[i].Name < report.Columns[j].Name })
+	sort.Strings(report.ColumnNames)
+
+	if report.Entities > 0 {
+		report.ItemSizes.Average = float64(report.totalSize) / float64(report.Entities)
+	}
+}
+
+// attributeTypes counts the different attribute types values of the given Edm types are converted to
+func attributeTypes(edmTypes map[string]int) int {
+	attributeTypes := map[string]bool{}
+	for edmType := range edmTypes {
+		switch edmType {
+		case "Edm.Int32", "Edm.Int64", "Edm.Double":
+			attributeTypes["N"] = true
+		case "Edm.String", "Edm.Guid", "Edm.DateTime":
+			attributeTypes["S"] = true
+		default:
+			attributeTypes[edmType] = true
+		}
+	}
+	return len(attributeTypes)
+}
@@ -14,18 +14,18 @@ type TestingConfig struct {
 }
 
 var (
-	config TestingConfig
+	config     TestingConfig
+	configured bool
 )
 
-func LoadTestingConfig() TestingConfig {
+func LoadTestingConfig() (TestingConfig, error) {
 
 	var testingConfig TestingConfig
 	var dynamoConfig DynamoConfig
 	err := envconfig.Process("DYNAMO", &dynamoConfig)
 
 	if err != nil {
-		log.Println(err.Error())
-		os.Exit(1)
+		return testingConfig, err
 	}
 	testingConfig.Dynamo = dynamoConfig
 
@@ -33,16 +33,29 @@ func LoadTestingConfig() TestingConfig {
 	err = envconfig.Process("TABLESTORAGE", &tsConfig)
 
 	if err != nil {
-		log.Println(err.Error())
-		os.Exit(1)
+		return testingConfig, err
 	}
 	testingConfig.TableStorage = tsConfig
 
-	return testingConfig
+	return testingConfig, nil
+}
+
+// requireCloud skips tests that talk to real table storage and dynamo when their env vars are missing.
+func requireCloud(t *testing.T) {
+	if !configured {
+		t.Skip("table storage and dynamo env vars are not configured")
+	}
 }
 
 func TestMain(m *testing.M) {
-	config = LoadTestingConfig()
+	var err error
+	config, err = LoadTestingConfig()
+
+	if err != nil {
+		log.Printf("Skipping integration tests: %v", err)
+	}
+	configured = err == nil
+
 	retCode := m.Run()
 	os.Exit(retCode)
 }
@@ -0,0 +1,22 @@
+package dataprovider
+
+import (
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// Sink is a store migrated items are written to. DynamoProvider is the default implementation.
+type Sink interface {
+	// WriteBatch writes items to the store and returns the items that could not be written.
+	WriteBatch(items []map[string]*dynamodb.AttributeValue) ([]map[string]*dynamodb.AttributeValue, error)
+	// DeleteBatch removes the items identified by keys from the store and returns the keys that could not be removed.
+	DeleteBatch(keys []map[string]*dynamodb.AttributeValue) ([]map[string]*dynamodb.AttributeValue, error)
+	// Flush writes out anything the sink has buffered. It is called once all work has completed.
+	Flush() error
+}
+
+// KeyVerifier is implemented by sinks that know the key schema of their store, so a key mapping that doesn't match
+// it is caught before anything is written.
+type KeyVerifier interface {
+	// VerifyKeys returns an error unless the store is keyed on the attributes named in keyNames, hash key first.
+	VerifyKeys(keyNames []string) error
+}
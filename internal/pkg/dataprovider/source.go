@@ -0,0 +1,72 @@
+package dataprovider
+
+import (
+	"fmt"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+)
+
+// RangeSpec describes the partition key space to migrate. Every prefix except the last is expanded
+// to Precision characters using the characters of Alphabet, the last prefix is the exclusive upper bound
+// of the final range. Partition keys are expected to be lowercase hex if no alphabet is given.
+type RangeSpec struct {
+	Prefixes  []string
+	Precision int
+	Alphabet  []string
+}
+
+// Continuation is where reading a range resumes, the keys of the first entity that has not been read yet
+type Continuation struct {
+	NextPartitionKey string
+	NextRowKey       string
+}
+
+// IsZero reports whether the continuation is empty. Reading from an empty continuation starts at the beginning of a
+// range, an empty continuation after a page means the range has been read completely.
+func (continuation Continuation) IsZero() bool {
+	return continuation == Continuation{}
+}
+
+// Source is a store entities can be migrated from. TableStorageProvider is the default implementation.
+type Source interface {
+	// Ranges enumerates the query ranges that together cover the key space described by spec.
+	Ranges(spec RangeSpec) ([]QueryRange, error)
+	// ReadPage returns the next page of entities with a partition key inside queryRange, starting at from, and
+	// where the page after it starts.
+	ReadPage(queryRange QueryRange, from Continuation) ([]*storage.Entity, Continuation, error)
+}
+
+// GenerateRanges expands the prefixes of spec into consecutive query ranges, i.e. prefixes "0,1,2" with
+// precision 2 become [00, 01), [01, 02) ... [1f, 2). Prefixes must be ascending and no prefix may be expanded
+// past the next one, so the ranges never overlap.
+func GenerateRanges(spec RangeSpec) ([]QueryRange, error) {
+	if len(spec.Prefixes) < 2 || spec.Precision < 1 {
+		return []QueryRange{}, nil
+	}
+
+	alphabet := spec.Alphabet
+	if len(alphabet) == 0 {
+		alphabet = hexLowerAlphabet
+	}
+
+	bounds := append([]string{}, spec.Prefixes[:len(spec.Prefixes)-1]...)
+	for precision := 1; precision < spec.Precision; precision++ {
+		expanded := make([]string, 0, len(bounds)*len(alphabet))
+		for _, bound := range bounds {
+			for _, code := range alphabet {
+				expanded = append(expanded, bound+code)
+			}
+		}
+		bounds = expanded
+	}
+	bounds = append(bounds, spec.Prefixes[len(spec.Prefixes)-1])
+
+	ranges := make([]QueryRange, 0, len(bounds)-1)
+	for i := 1; i < len(bounds); i++ {
+		if bounds[i-1] >= bounds[i] {
+			return nil, fmt.Errorf("range bounds %q and %q are out of order, check that the prefixes are ascending and fit the key alphabet", bounds[i-1], bounds[i])
+		}
+		ranges = append(ranges, NewQueryRange(bounds[i-1], bounds[i]))
+	}
+	return ranges, nil
+}
@@ -0,0 +1,38 @@
+package dataprovider
+
+// SplitPolicy decides when a read worker splits a range that turns out to be too big for a single worker
+type SplitPolicy struct {
+	MaxPages int      // split once this many pages of a range have been read, 0 disables
+	MaxBytes int      // split once this many bytes of a range have been read, 0 disables
+	Children int      `default:"4"` // how many ranges the unread rest of a split range is divided into
+	Alphabet []string `ignored:"true"`
+}
+
+// Enabled reports whether ranges are split at all
+func (policy SplitPolicy) Enabled() bool {
+	return policy.MaxPages > 0 || policy.MaxBytes > 0
+}
+
+// Exceeded reports whether a range of which pages pages and bytes bytes have been read should be split
+func (policy SplitPolicy) Exceeded(pages int, bytes int) bool {
+	return (policy.MaxPages > 0 && pages >= policy.MaxPages) || (policy.MaxBytes > 0 && bytes >= policy.MaxBytes)
+}
+
+// CanSplit reports whether queryRange can be split where next resumes reading. Ranges are only split between
+// partitions, so a range can't be split while its first partition is being read.
+func (policy SplitPolicy) CanSplit(queryRange QueryRange, next Continuation) bool {
+	return next.NextPartitionKey > queryRange.Ge && next.NextPartitionKey < queryRange.Lt
+}
+
+// Split divides queryRange at the partition next resumes reading in. The first child is the part that has been
+// read, the unread rest is divided into Children ranges of equal width in the key space.
+func (policy SplitPolicy) Split(queryRange QueryRange, next Continuation) []QueryRange {
+	children := policy.Children
+	if children < 1 {
+		children = 1
+	}
+
+	read := NewQueryRange(queryRange.Ge, next.NextPartitionKey)
+	unread := SplitRange(NewQueryRange(next.NextPartitionKey, queryRange.Lt), children, policy.Alphabet)
+	return append([]QueryRange{read}, unread...)
+}
@@ -0,0 +1,148 @@
+package dataprovider
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrLeaseLost is returned when a range is checkpointed by a process whose lease on it has been taken over
+var ErrLeaseLost = errors.New("lease on the range is held by another process")
+
+// RangeStatus is the outcome of migrating a query range
+type RangeStatus string
+
+const (
+	// RangeCompleted means every entity in the range landed in the sink
+	RangeCompleted RangeStatus = "completed"
+	// RangePartial means some entities in the range could not be written
+	RangePartial RangeStatus = "partial"
+	// RangeFailed means the range could not be read or none of its entities could be written
+	RangeFailed RangeStatus = "failed"
+	// RangeLeased means a worker has claimed the range and is migrating it
+	RangeLeased RangeStatus = "leased"
+	// RangePlanned means the range was planned from samples of the key space and has not been migrated yet
+	RangePlanned RangeStatus = "planned"
+	// RangeSplit means the range was too big for one worker and has been split into child ranges with records of
+	// their own
+	RangeSplit RangeStatus = "split"
+	// RangeIncomplete means the range was in flight when its process shut down
+	RangeIncomplete RangeStatus = "incomplete"
+)
+
+// Identity names the job and host processing ranges so every range record can be traced back to the pod
+// that wrote it
+type Identity struct {
+	JobID string
+	Host  string
+}
+
+// Owner identifies the process holding a lease. Identical pods share a job ID, so the host is part of it.
+func (identity Identity) Owner() string {
+	return identity.JobID + "@" + identity.Host
+}
+
+// RangeRecord is the status table entry for a query range
+type RangeRecord struct {
+	QueryRange
+	Status        RangeStatus
+	ItemsRead     int
+	ItemsWritten  int
+	ItemsRejected int `dynamodbav:",omitempty"` // rejected by the large item strategy, attempts resumed from a checkpoint carry them over
+	Bytes         int
+	StartedAt     time.Time
+	FinishedAt    time.Time
+	Attempt       int
+	JobID         string        `dynamodbav:",omitempty"`
+	Host          string        `dynamodbav:",omitempty"`
+	Error         string        `dynamodbav:",omitempty"`
+	LeaseOwner    string        `dynamodbav:",omitempty"`
+	LeaseExpires  int64         `dynamodbav:",omitempty"` // unix seconds
+	Children      []QueryRange  `dynamodbav:",omitempty"`
+	Checkpoint    *Continuation `dynamodbav:",omitempty"` // where to resume, everything before it has been written
+}
+
+// NewRangeRecord returns a record of queryRange with the given status
+func NewRangeRecord(queryRange QueryRange, status RangeStatus) RangeRecord {
+	return RangeRecord{QueryRange: queryRange, Status: status}
+}
+
+// Start stamps the record with the identity of the worker starting on it and the current time
+func (record *RangeRecord) Start(identity Identity) {
+	record.JobID = identity.JobID
+	record.Host = identity.Host
+	record.StartedAt = time.Now().UTC()
+}
+
+// Finish stamps the record with its final status, the error that caused it if any and the current time
+func (record *RangeRecord) Finish(status RangeStatus, err error) {
+	record.Status = status
+	record.FinishedAt = time.Now().UTC()
+	if err != nil {
+		record.Error = err.Error()
+	}
+}
+
+// Completed reports whether the range needs no further work. Records written before statuses were tracked
+// only exist for completed ranges.
+func (record RangeRecord) Completed() bool {
+	return record.Status == RangeCompleted || record.Status == ""
+}
+
+// HeldBy reports whether a record with a lease owner may be replaced by a record of owner. Records written outside
+// lease mode have no owner and replace any record.
+func (record RangeRecord) HeldBy(owner string) bool {
+	return owner == "" || record.LeaseOwner == "" || record.LeaseOwner == owner
+}
+
+// Resume returns where the next attempt at the range starts reading, the beginning of the range unless the record
+// has a checkpoint
+func (record RangeRecord) Resume() Continuation {
+	if record.Checkpoint == nil {
+		return Continuation{}
+	}
+	return *record.Checkpoint
+}
+
+// RejectedBefore returns how many entities before the checkpoint were rejected, the next attempt carries them over
+func (record RangeRecord) RejectedBefore() int {
+	if record.Checkpoint == nil {
+		return 0
+	}
+	return record.ItemsRejected
+}
+
+// Claimable reports whether the range may be leased at now. Planned ranges, expired leases and incomplete ranges
+// can be taken over, partial and failed ranges are retried until they have been attempted maxAttempts times.
+func (record RangeRecord) Claimable(now time.Time, maxAttempts int) bool {
+	switch record.Status {
+	case RangeLeased:
+		return record.LeaseExpires < now.Unix()
+	case RangePlanned, RangeIncomplete:
+		return true
+	case RangePartial, RangeFailed:
+		return record.Attempt < maxAttempts
+	}
+	return false
+}
+
+// StatusStore records the outcome of every query range so an interrupted migration can pick up where it
+// left off. DynamoProvider is the default implementation.
+type StatusStore interface {
+	// NewMigrationStatusTable creates the underlying status storage if it does not exist yet.
+	NewMigrationStatusTable() error
+	// ScanStatusTable returns every range record.
+	ScanStatusTable() []RangeRecord
+	// WriteRangeRecord stores record, replacing any earlier record of the same range. A record with a LeaseOwner is
+	// dropped if another owner holds the range.
+	WriteRangeRecord(record RangeRecord)
+	// CheckpointRange stores the Checkpoint and counts of record on the record of its range without changing its
+	// status or lease. A range without a record is recorded as incomplete. A record with a LeaseOwner returns
+	// ErrLeaseLost if another owner holds the range.
+	CheckpointRange(record RangeRecord) error
+	// ClaimRange atomically leases queryRange to identity until expires if the range has no record yet or its
+	// record is claimable. It returns the record as it was before the claim and whether the claim succeeded.
+	ClaimRange(queryRange QueryRange, identity Identity, expires time.Time, maxAttempts int) (RangeRecord, bool, error)
+	// RenewLease extends a lease identity holds on queryRange until expires. It returns false if the lease is no
+	// longer held, i.e. because the range has finished or another worker took it over.
+	RenewLease(queryRange QueryRange, identity Identity, expires time.Time) (bool, error)
+}
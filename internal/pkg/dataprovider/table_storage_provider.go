@@ -1,18 +1,25 @@
 package dataprovider
 
 import (
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
+	"net/url"
+	"strings"
 
 	"github.com/Azure/azure-sdk-for-go/storage"
 )
 
 // TableStorageConfig all config data required to init table storage connection
 type TableStorageConfig struct {
-	AccountName string   `required:"true"`
-	AccountKey  string   `required:"true"`
-	TableName   string   `required:"true"`
-	ColumnNames []string `required:"true"` // an array of column names other than partition key, row key, and timestamp
+	AccountName      string
+	AccountKey       string
+	ConnectionString string   // alternative to account name and key, i.e. UseDevelopmentStorage=true for Azurite
+	Endpoint         string   // overrides the scheme and host of the table service, i.e. http://azurite:10002
+	TableName        string   `required:"true"`
+	ColumnNames      []string // an array of column names other than partition key, row key, and timestamp
 }
 
 // TableStorageProvider reference to table storage table
@@ -20,9 +27,83 @@ type TableStorageProvider struct {
 	Table *storage.Table
 }
 
+// endpointTransport sends every request to a custom endpoint instead of the host the storage client built
+// the request for. Only the scheme and host change so shared key signatures stay valid.
+type endpointTransport struct {
+	endpoint *url.URL
+	base     http.RoundTripper
+}
+
+func (transport *endpointTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	redirected := *request
+	redirectedURL := *request.URL
+	redirectedURL.Scheme = transport.endpoint.Scheme
+	redirectedURL.Host = transport.endpoint.Host
+	redirected.URL = &redirectedURL
+	redirected.Host = ""
+
+	return transport.base.RoundTrip(&redirected)
+}
+
+func parseConnectionString(connectionString string) map[string]string {
+	settings := map[string]string{}
+
+	for _, pair := range strings.Split(connectionString, ";") {
+		separator := strings.IndexByte(pair, '=')
+		if separator <= 0 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(pair[:separator]))
+		settings[key] = strings.TrimSpace(pair[separator+1:])
+	}
+
+	return settings
+}
+
+func newTableStorageClient(config TableStorageConfig) (storage.Client, error) {
+	var client storage.Client
+	var err error
+	endpoint := config.Endpoint
+
+	switch {
+	case config.ConnectionString != "":
+		settings := parseConnectionString(config.ConnectionString)
+
+		if strings.EqualFold(settings["usedevelopmentstorage"], "true") {
+			client, err = storage.NewEmulatorClient()
+		} else {
+			client, err = storage.NewClientFromConnectionString(config.ConnectionString)
+		}
+
+		// the storage client only honours TableEndpoint for SAS connection strings
+		if endpoint == "" && settings["sharedaccesssignature"] == "" {
+			endpoint = settings["tableendpoint"]
+		}
+	case config.AccountName != "" && config.AccountKey != "":
+		client, err = storage.NewBasicClient(config.AccountName, config.AccountKey)
+	default:
+		return client, errors.New("table storage needs either a connection string or an account name and key")
+	}
+
+	if err != nil || endpoint == "" {
+		return client, err
+	}
+
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil {
+		return client, fmt.Errorf("invalid table storage endpoint %v: %v", endpoint, err)
+	}
+
+	client.HTTPClient = &http.Client{
+		Transport: &endpointTransport{endpoint: endpointURL, base: http.DefaultTransport},
+	}
+
+	return client, nil
+}
+
 // NewTableStorageProvider connects to table storage and dynamo tables
 func NewTableStorageProvider(config TableStorageConfig) TableStorageProvider {
-	cli, err := storage.NewBasicClient(config.AccountName, config.AccountKey)
+	cli, err := newTableStorageClient(config)
 
 	if err != nil {
 		log.Fatal(err)
@@ -49,10 +130,121 @@ func NewQueryRange(ge string, lt string) QueryRange {
 	}
 }
 
+// Ranges enumerates the query ranges to migrate by expanding the prefixes in spec
+func (provider *TableStorageProvider) Ranges(spec RangeSpec) ([]QueryRange, error) {
+	return GenerateRanges(spec)
+}
+
+// decodeContinuationKey turns a continuation token of table storage back into the key it stands for. Tokens look
+// like 1!8!MDBiMQ-- with the base64 encoded key at the end, padded with - instead of =. A token that can't be decoded
+// is an error, taking it for a key would resume reading at the wrong place.
+func decodeContinuationKey(token string) (string, error) {
+	if token == "" {
+		return "", nil
+	}
+
+	parts := strings.SplitN(token, "!", 3)
+	if len(parts) != 3 || parts[0] != "1" {
+		return "", fmt.Errorf("unknown continuation token %v", token)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.Replace(parts[2], "-", "=", -1))
+	if err != nil {
+		return "", fmt.Errorf("could not decode continuation token %v: %v", token, err)
+	}
+	return string(key), nil
+}
+
+// continuationFromLink returns where the page after the one nextLink was returned with starts
+func continuationFromLink(nextLink *string) (Continuation, error) {
+	if nextLink == nil {
+		return Continuation{}, nil
+	}
+
+	link, err := url.Parse(*nextLink)
+	if err != nil {
+		return Continuation{}, fmt.Errorf("could not parse next link %v: %v", *nextLink, err)
+	}
+
+	query := link.Query()
+	partitionKey, err := decodeContinuationKey(query.Get("NextPartitionKey"))
+	if err != nil {
+		return Continuation{}, err
+	}
+
+	rowKey, err := decodeContinuationKey(query.Get("NextRowKey"))
+	if err != nil {
+		return Continuation{}, err
+	}
+
+	return Continuation{NextPartitionKey: partitionKey, NextRowKey: rowKey}, nil
+}
+
+// odataString quotes value as a string literal of a filter, quotes in it are escaped by doubling them
+func odataString(value string) string {
+	return "'" + strings.Replace(value, "'", "''", -1) + "'"
+}
+
+// rangeFilter selects the entities of queryRange
+func rangeFilter(queryRange QueryRange) string {
+	return fmt.Sprintf("PartitionKey ge %v and PartitionKey lt %v", odataString(queryRange.Ge), odataString(queryRange.Lt))
+}
+
+// ReadPage queries one page of a range. Pages after the first are filtered on the keys of the continuation rather
+// than requested with the continuation token, so reading can resume from nothing but a continuation. The range starts
+// at the partition key of the continuation, which keeps the service from scanning the part already read.
+func (provider *TableStorageProvider) ReadPage(queryRange QueryRange, from Continuation) ([]*storage.Entity, Continuation, error) {
+	filter := rangeFilter(queryRange)
+	if !from.IsZero() {
+		resumed := NewQueryRange(from.NextPartitionKey, queryRange.Lt)
+		filter = fmt.Sprintf("%v and (PartitionKey gt %v or RowKey ge %v)", rangeFilter(resumed), odataString(from.NextPartitionKey), odataString(from.NextRowKey))
+	}
+
+	result, err := provider.Table.QueryEntities(30, storage.FullMetadata, &storage.QueryOptions{Filter: filter})
+	if err != nil {
+		log.Printf("Error reading page from table storage: %v", err)
+		return nil, Continuation{}, err
+	}
+
+	next, err := continuationFromLink(result.NextLink)
+	return result.Entities, next, err
+}
+
+// SampleKeys queries only the partition keys of the first limit entities in a range
+func (provider *TableStorageProvider) SampleKeys(queryRange QueryRange, limit int) ([]string, error) {
+	keys := []string{}
+	options := storage.QueryOptions{
+		Top:    uint(limit),
+		Filter: rangeFilter(queryRange),
+		Select: []string{"PartitionKey"},
+	}
+
+	result, err := provider.Table.QueryEntities(30, storage.MinimalMetadata, &options)
+	for err == nil {
+		for _, entity := range result.Entities {
+			keys = append(keys, entity.PartitionKey)
+		}
+
+		if len(keys) >= limit || result.NextLink == nil {
+			break
+		}
+		result, err = result.NextResults(nil)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(keys) > limit {
+		keys = keys[:limit]
+	}
+	return keys, nil
+}
+
 // ReadRange queries table storage on a range and returns the response
 func (provider *TableStorageProvider) ReadRange(queryRange QueryRange) ([]*storage.Entity, error) {
 	results := []*storage.Entity{}
-	filter := fmt.Sprintf("PartitionKey ge '%v' and PartitionKey lt '%v'", queryRange.Ge, queryRange.Lt)
+	filter := rangeFilter(queryRange)
 	options := storage.QueryOptions{
 		Filter: filter,
 	}
@@ -1,12 +1,24 @@
 package dataprovider
 
 import (
-	"fmt"
 	"log"
 	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
 )
 
-type TableStorageReadWork chan QueryRange
+// ReadTask is a query range to read, which attempt at migrating it this is and where reading starts, the
+// checkpoint an earlier attempt got to if any
+type ReadTask struct {
+	QueryRange
+	Attempt    int
+	From       Continuation
+	Rejected   int    // entities of the range before From that were rejected
+	LeaseOwner string // owner of the lease on the range in lease mode, its records are only written while it holds it
+}
+
+type TableStorageReadWork chan ReadTask
 
 type TableStorageReadWorker struct {
 	ID         int
@@ -25,28 +37,120 @@ func NewTableStorageReadWorker(id int, workerPool chan TableStorageReadWork) Tab
 	return worker
 }
 
-func (worker *TableStorageReadWorker) Start(tableStorage *TableStorageProvider, status *DynamoProvider, workQueue DynamoWriteWork, wg *sync.WaitGroup) {
+func (worker *TableStorageReadWorker) readPage(source Source, queryRange QueryRange, from Continuation, retry RetryPolicy) ([]*storage.Entity, Continuation, error) {
+	for attempt := 1; ; attempt++ {
+		entities, next, err := source.ReadPage(queryRange, from)
+
+		if err == nil || attempt >= retry.Attempts() {
+			return entities, next, err
+		}
+
+		delay := retry.Backoff(attempt)
+		log.Printf("Read worker %v: Attempt %v on range ge: %v and lt: %v failed, retrying in %v: %v\n", worker.ID, attempt, queryRange.Ge, queryRange.Lt, delay, err)
+		time.Sleep(delay)
+	}
+}
+
+// maxHeldEntities bounds how many entities of the partition a page ends in are held back from the write workers
+const maxHeldEntities = 1000
+
+// streamRange reads queryRange page by page from where the task starts and queues every page for writing as it arrives, blocking while the
+// write work queue is full. It stops once the range has been read completely or split says it is too big to read
+// in one go, and returns where reading stopped. While splitting is enabled the entities of the partition a page ends
+// in are held back until the next page, so a range is split before anything of the partition it is split at has
+// been written.
+func (worker *TableStorageReadWorker) streamRange(source Source, task ReadTask, retry RetryPolicy, split SplitPolicy, progress *rangeProgress, workQueue DynamoWriteWork) (Continuation, error) {
+	queryRange := task.QueryRange
+	held := []*storage.Entity{}
+	streamed := ""
+	next := task.From
+	bytes := 0
+
+	for pages := 1; ; pages++ {
+		page, following, err := worker.readPage(source, queryRange, next, retry)
+		if err != nil {
+			return next, err
+		}
+
+		bytes += entitiesSize(page)
+		next = following
+		entities := append(held, page...)
+		held = nil
+
+		if split.Enabled() && !next.IsZero() {
+			cut := len(entities)
+			for cut > 0 && entities[cut-1].PartitionKey == next.NextPartitionKey {
+				cut--
+			}
+			if len(entities)-cut <= maxHeldEntities {
+				entities, held = entities[:cut:cut], entities[cut:]
+			}
+		}
+
+		if len(entities) > 0 {
+			resume := next
+			if len(held) > 0 {
+				resume = Continuation{NextPartitionKey: held[0].PartitionKey, NextRowKey: held[0].RowKey}
+			}
+
+			streamed = entities[len(entities)-1].PartitionKey
+			page := progress.queued(len(entities), resume)
+			log.Printf("Read worker %v: Adding %v entities to work queue.\n", worker.ID, len(entities))
+			workQueue <- DynamoWriteBatch{progress: progress, page: page, entities: entities}
+		}
+
+		if next.IsZero() || (split.Exceeded(pages, bytes) && split.CanSplit(queryRange, next) && next.NextPartitionKey > streamed) {
+			return next, nil
+		}
+	}
+}
+
+// Start reads ranges handed to the worker and streams their entities to the write workers. Ranges that split
+// considers too big are split and their children handed to dispatchChildren before the split is recorded, the
+// first child is the part read so far and stays with the worker. Ranges are recorded in status once they have been written, unless status is nil.
+func (worker *TableStorageReadWorker) Start(source Source, status StatusStore, workQueue DynamoWriteWork, retry RetryPolicy, split SplitPolicy, dispatchChildren func(children []QueryRange), failures *FailedRanges, identity Identity, wg *sync.WaitGroup) {
 	go func() {
 		for {
 			worker.WorkerPool <- worker.Work
 			select {
-			case queryRange := <-worker.Work:
+			case task := <-worker.Work:
+				queryRange := task.QueryRange
 				log.Printf("Read worker %v: Recieved read work request on range ge: %v and lt: %v\n", worker.ID, queryRange.Ge, queryRange.Lt)
-				entities, err := tableStorage.ReadRange(queryRange)
+
+				record := RangeRecord{QueryRange: queryRange, Attempt: task.Attempt, LeaseOwner: task.LeaseOwner}
+				if !task.From.IsZero() {
+					log.Printf("Read worker %v: Resuming range ge: %v and lt: %v at %v\n", worker.ID, queryRange.Ge, queryRange.Lt, task.From.NextPartitionKey)
+					from := task.From
+					record.Checkpoint = &from
+					record.ItemsRejected = task.Rejected
+				}
+				record.Start(identity)
+				progress := newRangeProgress(record, status, failures, wg)
+				next, err := worker.streamRange(source, task, retry, split, progress, workQueue)
 
 				if err != nil {
+					log.Printf("Read worker %v: Giving up on range ge: %v and lt: %v: %v\n", worker.ID, queryRange.Ge, queryRange.Lt, err)
+					progress.doneReading(err)
 					break
 				}
 
-				if len(entities) > 0 {
-					log.Printf("Read worker %v: Adding %v entities to work queue.\n", worker.ID, len(entities))
-					workQueue <- DynamoWriteBatch{queryRange: queryRange, entities: entities}
-				} else {
-					status.WriteQueryRangeSuccess(queryRange)
-					wg.Done()
+				if !next.IsZero() {
+					children := split.Split(queryRange, next)
+					log.Printf("Read worker %v: Splitting range ge: %v and lt: %v into %v ranges at %v\n", worker.ID, queryRange.Ge, queryRange.Lt, len(children), next.NextPartitionKey)
+
+					dispatchChildren(children)
+					record.Children = children
+					record.Finish(RangeSplit, nil)
+					status.WriteRangeRecord(record)
+
+					child := RangeRecord{QueryRange: children[0], Attempt: 1, LeaseOwner: task.LeaseOwner}
+					child.Start(identity)
+					progress.narrow(child)
 				}
+
+				progress.doneReading(nil)
 			case <-worker.QuitChan:
-				fmt.Printf("worker%d: Stopping.", worker.ID)
+				log.Printf("worker%d: Stopping.", worker.ID)
 				return
 			}
 		}
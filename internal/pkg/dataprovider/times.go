@@ -0,0 +1,93 @@
+package dataprovider
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// TimeFormat is how times are written, one of the presets below or a layout as understood by time.Format
+type TimeFormat string
+
+const (
+	// TimeDefault writes times as S with microseconds, i.e. 2018-12-01T00:00:00.5Z
+	TimeDefault TimeFormat = ""
+	// TimeEpoch writes times as N, seconds since the unix epoch
+	TimeEpoch TimeFormat = "epoch"
+	// TimeEpochMillis writes times as N, milliseconds since the unix epoch
+	TimeEpochMillis TimeFormat = "epochmillis"
+	// TimeRFC3339 writes times as S in RFC3339 without fractional seconds
+	TimeRFC3339 TimeFormat = "rfc3339"
+	// TimeRFC3339Nano writes times as S in RFC3339 with nanoseconds
+	TimeRFC3339Nano TimeFormat = "rfc3339nano"
+)
+
+// ParseTimeFormat parses a preset in any case or a layout, an empty format is the default
+func ParseTimeFormat(format string) (TimeFormat, error) {
+	preset := TimeFormat(strings.ToLower(strings.TrimSpace(format)))
+	switch preset {
+	case TimeDefault, "default":
+		return TimeDefault, nil
+	case TimeEpoch, TimeEpochMillis, TimeRFC3339, TimeRFC3339Nano:
+		return preset, nil
+	}
+
+	// a layout without any element formats every time the same
+	if (time.Time{}).Format(format) == format {
+		return "", fmt.Errorf("time format %q is neither epoch, epochmillis, rfc3339, rfc3339nano nor a layout", format)
+	}
+	return TimeFormat(format), nil
+}
+
+// attribute writes t in the format, times are written in UTC
+func (format TimeFormat) attribute(t time.Time) *dynamodb.AttributeValue {
+	t = t.UTC()
+	switch format {
+	case TimeDefault:
+		return &dynamodb.AttributeValue{S: aws.String(t.Format(timeFormat))}
+	case TimeEpoch:
+		return numberAttribute(strconv.FormatInt(t.Unix(), 10))
+	case TimeEpochMillis:
+		return numberAttribute(strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10))
+	case TimeRFC3339:
+		return &dynamodb.AttributeValue{S: aws.String(t.Format(time.RFC3339))}
+	case TimeRFC3339Nano:
+		return &dynamodb.AttributeValue{S: aws.String(t.Format(time.RFC3339Nano))}
+	}
+	return &dynamodb.AttributeValue{S: aws.String(t.Format(string(format)))}
+}
+
+// TimeFormats holds how times are written, globally and per column. The entity's Timestamp is the column Timestamp.
+type TimeFormats struct {
+	Default TimeFormat
+	Columns map[string]TimeFormat // override Default for single columns
+}
+
+// ParseTimeFormats parses the global and per column formats as ParseTimeFormat understands them
+func ParseTimeFormats(format string, columns map[string]string) (TimeFormats, error) {
+	formats := TimeFormats{Columns: make(map[string]TimeFormat, len(columns))}
+
+	var err error
+	if formats.Default, err = ParseTimeFormat(format); err != nil {
+		return formats, err
+	}
+
+	for column, columnFormat := range columns {
+		if formats.Columns[column], err = ParseTimeFormat(columnFormat); err != nil {
+			return formats, fmt.Errorf("column %v: %v", column, err)
+		}
+	}
+	return formats, nil
+}
+
+// attribute writes t, a value of column, in the column's format
+func (formats TimeFormats) attribute(column string, t time.Time) *dynamodb.AttributeValue {
+	if format, found := formats.Columns[column]; found {
+		return format.attribute(t)
+	}
+	return formats.Default.attribute(t)
+}
@@ -0,0 +1,251 @@
+package dataprovider
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// TransformOp names what a transform step does
+type TransformOp string
+
+const (
+	// OpRename renames Column to To
+	OpRename TransformOp = "rename"
+	// OpDrop removes Column, or every attribute in Columns
+	OpDrop TransformOp = "drop"
+	// OpCast converts Column to Type
+	OpCast TransformOp = "cast"
+	// OpDefault sets Column to Value, converted to Type if set, unless it holds a value
+	OpDefault TransformOp = "default"
+	// OpSplit splits the string form of Column at Separator into the attributes in Columns, the last one gets the rest
+	OpSplit TransformOp = "split"
+	// OpConcat joins the string forms of the attributes in Columns with Separator into Column
+	OpConcat TransformOp = "concat"
+	// OpLower lower-cases the string Column
+	OpLower TransformOp = "lower"
+	// OpUpper upper-cases the string Column
+	OpUpper TransformOp = "upper"
+	// OpTemplate sets Column to Value with every {Name} replaced by the string form of attribute Name
+	OpTemplate TransformOp = "template"
+)
+
+// templatePlaceholder matches the attribute references of a template
+var templatePlaceholder = regexp.MustCompile(`{([^{}]+)}`)
+
+// Transform is a step of the pipeline items go through before they are written. Which fields are used depends on Op.
+type Transform struct {
+	Op        TransformOp `json:"op"`
+	Column    string      `json:"column,omitempty"`
+	Columns   []string    `json:"columns,omitempty"`
+	To        string      `json:"to,omitempty"`
+	Type      string      `json:"type,omitempty"`
+	Value     string      `json:"value,omitempty"`
+	Separator string      `json:"separator,omitempty"`
+}
+
+// Pipeline is the list of transforms applied to every item in order
+type Pipeline []Transform
+
+// ParsePipeline parses a pipeline from a JSON list of transforms, an empty string is an empty pipeline
+func ParsePipeline(value string) (Pipeline, error) {
+	pipeline := Pipeline{}
+	if strings.TrimSpace(value) == "" {
+		return pipeline, nil
+	}
+
+	if err := json.Unmarshal([]byte(value), &pipeline); err != nil {
+		return nil, fmt.Errorf("could not parse transforms: %v", err)
+	}
+	return pipeline, nil
+}
+
+// Validate checks that every step has what its op needs and that no step changes the key attributes in keyNames,
+// those are built by the key schema
+func (pipeline Pipeline) Validate(keyNames []string) error {
+	for i, step := range pipeline {
+		if err := step.validate(); err != nil {
+			return fmt.Errorf("transform %v (%v): %v", i+1, step.Op, err)
+		}
+
+		for _, name := range step.writes() {
+			for _, key := range keyNames {
+				if name == key {
+					return fmt.Errorf("transform %v (%v): key attribute %v can't be changed", i+1, step.Op, key)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (step Transform) validate() error {
+	switch step.Op {
+	case OpRename:
+		if step.Column == "" || step.To == "" {
+			return fmt.Errorf("needs column and to")
+		}
+	case OpDrop:
+		if step.Column == "" && len(step.Columns) == 0 {
+			return fmt.Errorf("needs column or columns")
+		}
+	case OpCast:
+		if step.Column == "" {
+			return fmt.Errorf("needs column")
+		}
+		if _, err := ParseColumnTypes(map[string]string{step.Column: step.Type}); err != nil {
+			return err
+		}
+	case OpDefault:
+		if step.Column == "" {
+			return fmt.Errorf("needs column")
+		}
+		if step.Type != "" {
+			if _, err := ParseColumnTypes(map[string]string{step.Column: step.Type}); err != nil {
+				return err
+			}
+		}
+		if _, err := step.defaultValue(); err != nil {
+			return err
+		}
+	case OpSplit, OpConcat:
+		if step.Column == "" || len(step.Columns) == 0 {
+			return fmt.Errorf("needs column and columns")
+		}
+		if step.Op == OpSplit && step.Separator == "" {
+			return fmt.Errorf("needs a separator")
+		}
+	case OpLower, OpUpper, OpTemplate:
+		if step.Column == "" {
+			return fmt.Errorf("needs column")
+		}
+	default:
+		return fmt.Errorf("unknown op, use rename, drop, cast, default, split, concat, lower, upper or template")
+	}
+	return nil
+}
+
+// writes returns the attributes the step changes
+func (step Transform) writes() []string {
+	switch step.Op {
+	case OpRename:
+		return []string{step.Column, step.To}
+	case OpDrop:
+		return append([]string{step.Column}, step.Columns...)
+	case OpSplit:
+		return step.Columns
+	}
+	return []string{step.Column}
+}
+
+// Apply runs every step of the pipeline on item, the first step that can't be applied fails it
+func (pipeline Pipeline) Apply(item map[string]*dynamodb.AttributeValue) error {
+	for i, step := range pipeline {
+		if err := step.apply(item); err != nil {
+			return fmt.Errorf("transform %v (%v) of %v: %v", i+1, step.Op, step.Column, err)
+		}
+	}
+	return nil
+}
+
+func (step Transform) apply(item map[string]*dynamodb.AttributeValue) error {
+	value, found := item[step.Column]
+
+	switch step.Op {
+	case OpRename:
+		if found {
+			delete(item, step.Column)
+			item[step.To] = value
+		}
+	case OpDrop:
+		delete(item, step.Column)
+		for _, column := range step.Columns {
+			delete(item, column)
+		}
+	case OpCast:
+		if found && value.NULL == nil {
+			cast, err := convertAttribute(value, AttributeType(strings.ToUpper(step.Type)))
+			if err != nil {
+				return err
+			}
+			item[step.Column] = cast
+		}
+	case OpDefault:
+		if !found || value.NULL != nil {
+			defaultValue, err := step.defaultValue()
+			if err != nil {
+				return err
+			}
+			item[step.Column] = defaultValue
+		}
+	case OpSplit:
+		if found {
+			text, err := stringForm(value)
+			if err != nil {
+				return err
+			}
+			for i, part := range strings.SplitN(text, step.Separator, len(step.Columns)) {
+				item[step.Columns[i]] = &dynamodb.AttributeValue{S: aws.String(part)}
+			}
+		}
+	case OpConcat:
+		parts := make([]string, 0, len(step.Columns))
+		for _, column := range step.Columns {
+			if part, found := item[column]; found {
+				text, err := stringForm(part)
+				if err != nil {
+					return err
+				}
+				parts = append(parts, text)
+			}
+		}
+		if len(parts) > 0 {
+			item[step.Column] = &dynamodb.AttributeValue{S: aws.String(strings.Join(parts, step.Separator))}
+		}
+	case OpLower, OpUpper:
+		if found && value.S != nil {
+			changeCase := strings.ToLower
+			if step.Op == OpUpper {
+				changeCase = strings.ToUpper
+			}
+			item[step.Column] = &dynamodb.AttributeValue{S: aws.String(changeCase(*value.S))}
+		}
+	case OpTemplate:
+		var err error
+		text := templatePlaceholder.ReplaceAllStringFunc(step.Value, func(placeholder string) string {
+			referenced, found := item[placeholder[1:len(placeholder)-1]]
+			if !found || err != nil {
+				return ""
+			}
+			var text string
+			text, err = stringForm(referenced)
+			return text
+		})
+		if err != nil {
+			return err
+		}
+		item[step.Column] = &dynamodb.AttributeValue{S: aws.String(text)}
+	}
+	return nil
+}
+
+func (step Transform) defaultValue() (*dynamodb.AttributeValue, error) {
+	return columnAttribute(step.Value, AttributeType(strings.ToUpper(step.Type)))
+}
+
+// stringForm returns value as a string the way a cast to S would, NULL is the empty string
+func stringForm(value *dynamodb.AttributeValue) (string, error) {
+	if value.NULL != nil {
+		return "", nil
+	}
+
+	converted, err := convertAttribute(value, TypeString)
+	if err != nil {
+		return "", err
+	}
+	return *converted.S, nil
+}
@@ -0,0 +1,114 @@
+package dataprovider
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// TTLPolicy derives the expiry dynamo TTL deletes items at from a time of the entity plus a retention
+type TTLPolicy struct {
+	Attribute   string        // attribute the expiry is written to in epoch seconds, no expiry is written if empty
+	From        string        // column holding the time the retention counts from, the entity's Timestamp if empty
+	Retention   time.Duration // how long items are kept after From
+	SkipExpired bool          // don't write entities whose expiry has already passed
+}
+
+// Validate checks that the expiry doesn't overwrite a key attribute and that skipping has an expiry to go by
+func (policy TTLPolicy) Validate(keyNames []string) error {
+	if policy.Attribute == "" {
+		if policy.SkipExpired || policy.From != "" || policy.Retention != 0 {
+			return fmt.Errorf("TTL_ATTRIBUTE is needed to derive an expiry")
+		}
+		return nil
+	}
+
+	for _, key := range keyNames {
+		if policy.Attribute == key {
+			return fmt.Errorf("expiry can't be written to key attribute %v", key)
+		}
+	}
+
+	if policy.Retention < 0 {
+		return fmt.Errorf("retention %v is negative", policy.Retention)
+	}
+	return nil
+}
+
+// TTL derives expiries according to its policy and counts the entities skipped because they already expired. The
+// nil value derives none.
+type TTL struct {
+	policy  TTLPolicy
+	now     func() time.Time
+	expired int64
+}
+
+// NewTTL returns a TTL deriving expiries according to policy
+func NewTTL(policy TTLPolicy) *TTL {
+	return &TTL{policy: policy, now: time.Now}
+}
+
+// Expired returns how many entities were skipped because they already expired
+func (ttl *TTL) Expired() int {
+	if ttl == nil {
+		return 0
+	}
+	return int(atomic.LoadInt64(&ttl.expired))
+}
+
+// expiry returns the expiry attribute of entity and whether the entity is written at all. Entities without the
+// column expiries are derived from don't expire.
+func (ttl *TTL) expiry(entity *storage.Entity) (string, *dynamodb.AttributeValue, bool, error) {
+	if ttl == nil || ttl.policy.Attribute == "" {
+		return "", nil, true, nil
+	}
+
+	from := entity.TimeStamp
+	if ttl.policy.From != "" && ttl.policy.From != "Timestamp" {
+		value, found := entity.Properties[ttl.policy.From]
+		if !found || value == nil || value == "" {
+			return "", nil, true, nil
+		}
+
+		var err error
+		if from, err = timeOf(value); err != nil {
+			return "", nil, false, fmt.Errorf("column %v: %v", ttl.policy.From, err)
+		}
+	}
+
+	expires := from.Add(ttl.policy.Retention)
+	if ttl.policy.SkipExpired && !expires.After(ttl.now()) {
+		atomic.AddInt64(&ttl.expired, 1)
+		return "", nil, false, nil
+	}
+	return ttl.policy.Attribute, numberAttribute(strconv.FormatInt(expires.Unix(), 10)), true, nil
+}
+
+// timeOf reads a time from a value, strings have to be in RFC3339 and numbers are seconds since the unix epoch
+func timeOf(value interface{}) (time.Time, error) {
+	switch value := value.(type) {
+	case time.Time:
+		return value, nil
+	case string:
+		parsed, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("%q is not an RFC3339 time", value)
+		}
+		return parsed, nil
+	case int32:
+		return time.Unix(int64(value), 0), nil
+	case int64:
+		return time.Unix(value, 0), nil
+	case float64:
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return time.Time{}, fmt.Errorf("%v is not a time", value)
+		}
+		return time.Unix(int64(value), 0), nil
+	}
+	return time.Time{}, fmt.Errorf("%T is not a time", value)
+}
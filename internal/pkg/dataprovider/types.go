@@ -0,0 +1,186 @@
+package dataprovider
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/satori/go.uuid"
+)
+
+// AttributeType is a dynamo attribute type columns can be converted to
+type AttributeType string
+
+const (
+	// TypeString converts values to S, binary values are base64 encoded
+	TypeString AttributeType = "S"
+	// TypeNumber converts values to N, strings have to hold a number and booleans become 1 or 0
+	TypeNumber AttributeType = "N"
+	// TypeBinary converts values to B, strings are stored as their bytes and guids as their 16 bytes
+	TypeBinary AttributeType = "B"
+	// TypeBool converts values to BOOL, strings have to hold a boolean and numbers are true unless 0
+	TypeBool AttributeType = "BOOL"
+	// TypeJSON decodes strings holding JSON, objects become M, arrays L and scalars S, N, BOOL or NULL
+	TypeJSON AttributeType = "JSON"
+	// TypeMap decodes strings holding a JSON object to M
+	TypeMap AttributeType = "M"
+	// TypeList decodes strings holding a JSON array to L
+	TypeList AttributeType = "L"
+	// TypeStringSet decodes strings holding a JSON array of strings to SS
+	TypeStringSet AttributeType = "SS"
+	// TypeNumberSet decodes strings holding a JSON array of numbers to NS
+	TypeNumberSet AttributeType = "NS"
+)
+
+// timeFormat is how times are written unless configured otherwise
+const timeFormat = "2006-01-02T15:04:05.999999Z"
+
+// ParseColumnTypes parses per column type overrides, column names mapped to S, N, B, BOOL or one of the JSON types
+// JSON, M, L, SS and NS in any case
+func ParseColumnTypes(types map[string]string) (map[string]AttributeType, error) {
+	parsed := make(map[string]AttributeType, len(types))
+	for column, name := range types {
+		attributeType := AttributeType(strings.ToUpper(name))
+		switch attributeType {
+		case TypeString, TypeNumber, TypeBinary, TypeBool, TypeJSON, TypeMap, TypeList, TypeStringSet, TypeNumberSet:
+			parsed[column] = attributeType
+		default:
+			return nil, fmt.Errorf("column %v can't be converted to %q, use S, N, B, BOOL, JSON, M, L, SS or NS", column, name)
+		}
+	}
+	return parsed, nil
+}
+
+// edmAttribute converts a property value to the attribute its Edm type maps to. Edm.String, Edm.Guid and
+// Edm.DateTime become S, Edm.Int32, Edm.Int64 and Edm.Double become N, Edm.Binary becomes B and Edm.Boolean BOOL.
+// Nulls are returned as nil, empty strings as an empty S, the mapping's EmptyValues decide whether either is migrated.
+func edmAttribute(value interface{}) (*dynamodb.AttributeValue, error) {
+	switch value := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return &dynamodb.AttributeValue{S: aws.String(value)}, nil
+	case int:
+		return numberAttribute(strconv.FormatInt(int64(value), 10)), nil
+	case int32:
+		return numberAttribute(strconv.FormatInt(int64(value), 10)), nil
+	case int64:
+		return numberAttribute(strconv.FormatInt(value, 10)), nil
+	case float64:
+		// Edm.Int32 arrives as a float64 from the JSON of table storage
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return nil, fmt.Errorf("%v can't be stored as a dynamo number", value)
+		}
+		return numberAttribute(strconv.FormatFloat(value, 'f', -1, 64)), nil
+	case bool:
+		return &dynamodb.AttributeValue{BOOL: aws.Bool(value)}, nil
+	case time.Time:
+		return &dynamodb.AttributeValue{S: aws.String(value.UTC().Format(timeFormat))}, nil
+	case uuid.UUID:
+		return &dynamodb.AttributeValue{S: aws.String(value.String())}, nil
+	case []byte:
+		return &dynamodb.AttributeValue{B: value}, nil
+	}
+	return nil, fmt.Errorf("unsupported type %T", value)
+}
+
+func numberAttribute(number string) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{N: aws.String(number)}
+}
+
+// columnAttribute converts a property value to attributeType, or to the type its Edm type maps to if
+// attributeType is empty
+func columnAttribute(value interface{}, attributeType AttributeType) (*dynamodb.AttributeValue, error) {
+	if id, ok := value.(uuid.UUID); ok && attributeType == TypeBinary {
+		return &dynamodb.AttributeValue{B: id.Bytes()}, nil
+	}
+
+	attribute, err := edmAttribute(value)
+	if err != nil || attributeType == "" {
+		return attribute, err
+	}
+	return convertAttribute(attribute, attributeType)
+}
+
+// convertAttribute converts attribute, as edmAttribute returned it, to attributeType
+func convertAttribute(attribute *dynamodb.AttributeValue, attributeType AttributeType) (*dynamodb.AttributeValue, error) {
+	switch {
+	case attribute == nil:
+		return nil, nil
+	case attributeType.isJSON() && attribute.S != nil:
+		return jsonAttribute(*attribute.S, attributeType)
+	case attributeType == TypeString:
+		switch {
+		case attribute.N != nil:
+			return &dynamodb.AttributeValue{S: attribute.N}, nil
+		case attribute.BOOL != nil:
+			return &dynamodb.AttributeValue{S: aws.String(strconv.FormatBool(*attribute.BOOL))}, nil
+		case attribute.B != nil:
+			return &dynamodb.AttributeValue{S: aws.String(base64.StdEncoding.EncodeToString(attribute.B))}, nil
+		}
+	case attributeType == TypeNumber:
+		switch {
+		case attribute.S != nil:
+			number, err := strconv.ParseFloat(strings.TrimSpace(*attribute.S), 64)
+			if err != nil || math.IsNaN(number) || math.IsInf(number, 0) {
+				return nil, fmt.Errorf("%q is not a number", *attribute.S)
+			}
+			return numberAttribute(strings.TrimSpace(*attribute.S)), nil
+		case attribute.BOOL != nil:
+			if *attribute.BOOL {
+				return numberAttribute("1"), nil
+			}
+			return numberAttribute("0"), nil
+		}
+	case attributeType == TypeBinary:
+		if attribute.S != nil {
+			return &dynamodb.AttributeValue{B: []byte(*attribute.S)}, nil
+		}
+	case attributeType == TypeBool:
+		switch {
+		case attribute.S != nil:
+			value, err := strconv.ParseBool(strings.TrimSpace(*attribute.S))
+			if err != nil {
+				return nil, fmt.Errorf("%q is not a boolean", *attribute.S)
+			}
+			return &dynamodb.AttributeValue{BOOL: aws.Bool(value)}, nil
+		case attribute.N != nil:
+			number, _ := strconv.ParseFloat(*attribute.N, 64)
+			return &dynamodb.AttributeValue{BOOL: aws.Bool(number != 0)}, nil
+		}
+	}
+
+	if attributeTypeOf(attribute) == attributeType {
+		return attribute, nil
+	}
+	return nil, fmt.Errorf("%v can't be converted to %v", attributeTypeOf(attribute), attributeType)
+}
+
+func attributeTypeOf(attribute *dynamodb.AttributeValue) AttributeType {
+	switch {
+	case attribute.S != nil:
+		return TypeString
+	case attribute.N != nil:
+		return TypeNumber
+	case attribute.B != nil:
+		return TypeBinary
+	case attribute.BOOL != nil:
+		return TypeBool
+	case attribute.M != nil:
+		return TypeMap
+	case attribute.L != nil:
+		return TypeList
+	case attribute.SS != nil:
+		return TypeStringSet
+	case attribute.NS != nil:
+		return TypeNumberSet
+	case attribute.NULL != nil:
+		return "NULL"
+	}
+	return ""
+}